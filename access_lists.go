@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dessources/go_rate_limiter/ratelimit"
+)
+
+// AccessList matches requests by the IP they come from or the API key they carry.
+type AccessList struct {
+	Cidrs   []string `json:"cidrs"`   // e.g. "10.0.0.0/8", "2001:db8::/32", see NewAccessLists for bare IPs
+	ApiKeys []string `json:"apiKeys"` // compared with the X-API-Key header
+}
+
+type AccessListsConfig struct {
+	Allow AccessList `json:"allow"`
+	Deny  AccessList `json:"deny"`
+}
+
+type accessVerdict int
+
+const (
+	accessUnlisted accessVerdict = iota
+	accessAllowed
+	accessDenied
+)
+
+type accessRules struct {
+	config        AccessListsConfig
+	allowPrefixes []netip.Prefix
+	denyPrefixes  []netip.Prefix
+	allowKeys     map[string]struct{}
+	denyKeys      map[string]struct{}
+}
+
+// AccessLists exempts allowlisted clients from rate limiting and refuses
+// denylisted ones. The lists can be replaced while requests are served.
+type AccessLists struct {
+	rules atomic.Pointer[accessRules]
+	mask  ClientMask
+}
+
+// NewAccessLists widens bare IPs of the denylist to the network mask
+// identifies clients by, so a ban covers every address the client could
+// rotate through. Bare IPs of the allowlist only match themselves, so
+// exempting one host doesn't exempt its neighbours.
+func NewAccessLists(config AccessListsConfig, mask ClientMask) (*AccessLists, error) {
+	lists := &AccessLists{mask: mask}
+	if err := lists.Set(config); err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+// Set validates config and swaps it in, the previous lists are kept on error.
+func (a *AccessLists) Set(config AccessListsConfig) error {
+	rules := &accessRules{}
+	var err error
+	if rules.allowPrefixes, config.Allow.Cidrs, err = parsePrefixes(config.Allow.Cidrs, ClientMask{}); err != nil {
+		return err
+	}
+	if rules.denyPrefixes, config.Deny.Cidrs, err = parsePrefixes(config.Deny.Cidrs, a.mask); err != nil {
+		return err
+	}
+	rules.allowKeys, config.Allow.ApiKeys = keySet(config.Allow.ApiKeys)
+	rules.denyKeys, config.Deny.ApiKeys = keySet(config.Deny.ApiKeys)
+	rules.config = config
+
+	a.rules.Store(rules)
+	return nil
+}
+
+func (a *AccessLists) Config() AccessListsConfig {
+	return a.rules.Load().config
+}
+
+// parsePrefixes widens bare IPs with mask, the zero ClientMask keeps them
+// exact. It also returns the entries in canonical form, so the lists read
+// back the way they are matched.
+func parsePrefixes(entries []string, mask ClientMask) ([]netip.Prefix, []string, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	canonical := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var prefix netip.Prefix
+		if strings.Contains(entry, "/") {
+			p, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Invalid CIDR %q.", entry)
+			}
+			prefix = p.Masked()
+		} else {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil || addr.Zone() != "" {
+				return nil, nil, fmt.Errorf("Invalid IP %q.", entry)
+			}
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+			if network, err := netip.ParsePrefix(mask.Mask(addr.String())); err == nil {
+				prefix = network
+			}
+		}
+		prefixes = append(prefixes, prefix)
+		canonical = append(canonical, prefix.String())
+	}
+	return prefixes, canonical, nil
+}
+
+func keySet(keys []string) (map[string]struct{}, []string) {
+	set := make(map[string]struct{}, len(keys))
+	kept := make([]string, 0, len(keys))
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if _, seen := set[key]; key == "" || seen {
+			continue
+		}
+		set[key] = struct{}{}
+		kept = append(kept, key)
+	}
+	return set, kept
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// check matches r against the lists, the denylist wins when both match.
+func (a *AccessLists) check(r *http.Request) accessVerdict {
+	rules := a.rules.Load()
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	hasAddr := err == nil
+	addr = addr.Unmap()
+
+	apiKey := r.Header.Get("X-API-Key")
+	_, keyDenied := rules.denyKeys[apiKey]
+	_, keyAllowed := rules.allowKeys[apiKey]
+
+	switch {
+	case (apiKey != "" && keyDenied) || (hasAddr && containsAddr(rules.denyPrefixes, addr)):
+		return accessDenied
+	case (apiKey != "" && keyAllowed) || (hasAddr && containsAddr(rules.allowPrefixes, addr)):
+		return accessAllowed
+	}
+	return accessUnlisted
+}
+
+type exemptKey struct{}
+
+// isExemptFromLimits reports whether r was allowlisted by MakeAccessListMiddleware.
+func isExemptFromLimits(r *http.Request) bool {
+	exempt, _ := r.Context().Value(exemptKey{}).(bool)
+	return exempt
+}
+
+// MakeAccessListMiddleware refuses denylisted requests with a 403 and marks
+// allowlisted ones so the rate limiters let them through. It has to run
+// before the rate limiting middlewares.
+func MakeAccessListMiddleware(logger *slog.Logger, lists *AccessLists) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch lists.check(r) {
+			case accessDenied:
+				ip, _ := ratelimit.ClientIP(r)
+				logger.Warn("denylisted request refused", "remote_addr", r.RemoteAddr, "client_network", lists.mask.Mask(ip), "path", r.URL.Path)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(&ErrorResponse{"Access denied."})
+				return
+			case accessAllowed:
+				r = r.WithContext(context.WithValue(r.Context(), exemptKey{}, true))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
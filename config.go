@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
@@ -9,29 +10,80 @@ import (
 
 type Config struct {
 	//General config
-	baseUrl string
+	baseUrl     string
+	AdminApiKey string
 
 	// Server configuration
+	Mode               string // "shortener", or "proxy" to only forward to the upstreams in ProxyConfigPath
+	ProxyConfigPath    string
+	ProxyMetricsPath   string // where the proxy streams its metrics to admins, empty to not serve them
 	ServerAddr         string
+	StorageType        StorageType // backing store of the limiters and the shortener
 	TestServerAddr     string
 	CorsAllowedOrigins []string
 
 	// Global Rate Limiter
-	GlobalLimiterCount int
-	GlobalLimiterCap   int
-	GlobalLimiterRate  int
+	GlobalLimiterCount  int
+	GlobalLimiterCap    int
+	GlobalLimiterRate   int
+	GlobalLimiterShadow bool // count would-be rejections without refusing requests
 
 	// Per-Client Rate Limiter
 	PerClientLimiterCap       int
 	PerClientLimiterLimit     int
 	PerClientLimiterWindow    time.Duration
 	PerClientLimiterClientTtl time.Duration
+	PerClientLimiterShadow    bool
+	ClientMask                ClientMask // prefix of the IP that identifies a client, for limits, bans and analytics
+	// a shadow limiter with this limit runs next to the per-client limiter, 0 disables it
+	ShadowPerClientLimiterLimit int
 
 	// URL Shortener
-	ShortenerCap    int
-	ShortenerTTL    time.Duration
-	ShortCodeLength int
-	MaxUrlLength    int
+	ShortenerCap      int
+	ShortenerTTL      time.Duration
+	ShortCodeLength   int
+	MaxUrlLength      int
+	ShortenerDedupe   bool // reuse an owner's live short code for the same destination
+	ShortenerEviction EvictionPolicy
+	MaxBatchSize      int
+	MaxAliasLength    int
+	MaxQRSize         int
+	MaxImportSize     int64
+
+	// Password-protected links
+	PasswordAttemptLimit  int
+	PasswordAttemptWindow time.Duration
+
+	// Allow and deny lists at startup, replaceable at runtime through /api/admin/access-lists
+	AccessLists AccessListsConfig
+
+	// Destination url policy
+	BlockedDomains    []string
+	AllowPrivateHosts bool
+	ResolveUrlHosts   bool
+	urlPolicy         *UrlPolicy
+
+	// Metrics stream
+	MetricsMaxSubscribers int
+	MetricsHistorySize    int // points kept for clients that reconnect
+
+	// Stress test suites are read from StressScenarioDir, reports written to StressReportDir
+	StressScenarioDir     string
+	StressReportDir       string
+	StressReportRetention int // reports kept in StressReportDir, 0 keeps all
+	StressTestConcurrency int // runs allowed at once, the rest wait in line
+	StressTestMaxQueue    int
+
+	// Limiter state is saved here on shutdown and restored on startup, empty disables it
+	LimiterSnapshotPath string
+
+	// Named limits served by /api/ratelimit, which require RateLimitApiKey
+	NamedLimitsPath string
+	RateLimitApiKey string
+
+	// Envoy rate limit service, started when RlsAddr is set
+	RlsAddr       string
+	RlsConfigPath string
 
 	//others
 	Fallback404HTML string
@@ -44,26 +96,110 @@ func LoadConfig() (*Config, error) {
 	corsAllowedOrigins := append([]string{baseUrl},
 		getEnvAsSlice("CORS_ALLOWED_ORIGINS", []string{"http://localhost:3000", "http://localhost:8090"})...)
 
+	blockedDomains := getEnvAsSlice("BLOCKED_DOMAINS", []string{})
+	allowPrivateHosts := getEnvAsBool("ALLOW_PRIVATE_HOSTS", false)
+	resolveUrlHosts := getEnvAsBool("RESOLVE_URL_HOSTS", true)
+	urlPolicy, err := NewUrlPolicy(baseUrl, blockedDomains, allowPrivateHosts, resolveUrlHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	clientMask := ClientMask{IPv4Bits: getEnvAsInt("CLIENT_IPV4_PREFIX", 32), IPv6Bits: getEnvAsInt("CLIENT_IPV6_PREFIX", 64)}
+	if clientMask.IPv4Bits < 1 || clientMask.IPv4Bits > 32 || clientMask.IPv6Bits < 1 || clientMask.IPv6Bits > 128 {
+		return nil, fmt.Errorf("client prefixes must be between /1 and /32 for IPv4 and /1 and /128 for IPv6, got /%d and /%d", clientMask.IPv4Bits, clientMask.IPv6Bits)
+	}
+
+	metricsMaxSubscribers := getEnvAsInt("METRICS_MAX_SUBSCRIBERS", 1000)
+	metricsHistorySize := getEnvAsInt("METRICS_HISTORY_SIZE", 300)
+	if metricsMaxSubscribers < 0 || metricsHistorySize < 0 {
+		return nil, fmt.Errorf("metrics subscriber cap and history size must not be negative, got %d and %d", metricsMaxSubscribers, metricsHistorySize)
+	}
+
+	storageType, err := ParseStorageType(getEnv("STORAGE_TYPE", "memory"))
+	if err != nil {
+		return nil, err
+	}
+
+	shortenerEviction, err := ParseEvictionPolicy(getEnv("SHORTENER_EVICTION", "reject"))
+	if err != nil {
+		return nil, err
+	}
+
+	mode := getEnv("MODE", "shortener")
+	if mode != "shortener" && mode != "proxy" {
+		return nil, fmt.Errorf("unknown mode %q, expected shortener or proxy", mode)
+	}
+
+	proxyMetricsPath := getEnv("PROXY_METRICS_PATH", "")
+	if proxyMetricsPath != "" && !strings.HasPrefix(proxyMetricsPath, "/") {
+		return nil, fmt.Errorf("PROXY_METRICS_PATH %q must start with /", proxyMetricsPath)
+	}
+
 	return &Config{
 		baseUrl:            baseUrl,
+		AdminApiKey:        getEnv("ADMIN_API_KEY", ""),
+		Mode:               mode,
+		ProxyConfigPath:    getEnv("PROXY_CONFIG_PATH", "proxy_config.json"),
+		ProxyMetricsPath:   proxyMetricsPath,
 		ServerAddr:         getEnv("SERVER_ADDR", ":8090"),
-		TestServerAddr:     getEnv("TEST_SERVER_ADDR", ":8091"),
+		StorageType:        storageType,
+		TestServerAddr:     getEnv("TEST_SERVER_ADDR", "127.0.0.1:0"),
 		CorsAllowedOrigins: corsAllowedOrigins,
 
-		GlobalLimiterCount: globalCap, // Often the same as cap at start
-		GlobalLimiterCap:   globalCap,
-		GlobalLimiterRate:  getEnvAsInt("GLOBAL_LIMITER_RATE", 10000*60),
+		GlobalLimiterCount:  globalCap, // Often the same as cap at start
+		GlobalLimiterCap:    globalCap,
+		GlobalLimiterRate:   getEnvAsInt("GLOBAL_LIMITER_RATE", 10000*60),
+		GlobalLimiterShadow: getEnvAsBool("GLOBAL_LIMITER_SHADOW", false),
 
 		PerClientLimiterCap:    getEnvAsInt("PER_CLIENT_LIMITER_CAP", 50000),
 		PerClientLimiterLimit:  getEnvAsInt("PER_CLIENT_LIMITER_LIMIT", 10),
 		PerClientLimiterWindow: getEnvAsDuration("PER_CLIENT_WINDOW_SECONDS", 60*time.Second),
 
-		PerClientLimiterClientTtl: getEnvAsDuration("PER_CLIENT_LIMITER_CLIENT_TTL", time.Minute*30),
+		PerClientLimiterClientTtl:   getEnvAsDuration("PER_CLIENT_LIMITER_CLIENT_TTL", time.Minute*30),
+		PerClientLimiterShadow:      getEnvAsBool("PER_CLIENT_LIMITER_SHADOW", false),
+		ClientMask:                  clientMask,
+		ShadowPerClientLimiterLimit: getEnvAsInt("SHADOW_PER_CLIENT_LIMITER_LIMIT", 0),
+
+		ShortenerCap:      getEnvAsInt("SHORTENER_CAP", 100000),
+		ShortenerTTL:      getEnvAsDuration("SHORTENER_TTL_HOURS", time.Hour),
+		ShortCodeLength:   getEnvAsInt("SHORT_CODE_LENGTH", 4),
+		MaxUrlLength:      getEnvAsInt("MAX_URL_LENGTH", 4096),
+		ShortenerDedupe:   getEnvAsBool("SHORTENER_DEDUPE", false),
+		ShortenerEviction: shortenerEviction,
+		MaxBatchSize:      getEnvAsInt("MAX_BATCH_SIZE", 500),
+		MaxAliasLength:    getEnvAsInt("MAX_ALIAS_LENGTH", 32),
+		MaxQRSize:         getEnvAsInt("QR_MAX_SIZE", 1024),
+		MaxImportSize:     int64(getEnvAsInt("MAX_IMPORT_BYTES", 64<<20)),
+
+		PasswordAttemptLimit:  getEnvAsInt("PASSWORD_ATTEMPT_LIMIT", 5),
+		PasswordAttemptWindow: getEnvAsDuration("PASSWORD_ATTEMPT_WINDOW_SECONDS", 15*time.Minute),
+
+		BlockedDomains:    blockedDomains,
+		AllowPrivateHosts: allowPrivateHosts,
+		ResolveUrlHosts:   resolveUrlHosts,
+		urlPolicy:         urlPolicy,
+
+		AccessLists: AccessListsConfig{
+			Allow: AccessList{Cidrs: getEnvAsSlice("ALLOWLIST_CIDRS", nil), ApiKeys: getEnvAsSlice("ALLOWLIST_API_KEYS", nil)},
+			Deny:  AccessList{Cidrs: getEnvAsSlice("DENYLIST_CIDRS", nil), ApiKeys: getEnvAsSlice("DENYLIST_API_KEYS", nil)},
+		},
+
+		MetricsMaxSubscribers: metricsMaxSubscribers,
+		MetricsHistorySize:    metricsHistorySize,
+
+		StressScenarioDir:     getEnv("STRESS_SCENARIO_DIR", "stress_scenarios"),
+		StressReportDir:       getEnv("STRESS_REPORT_DIR", "stress_reports"),
+		StressReportRetention: getEnvAsInt("STRESS_REPORT_RETENTION", 100),
+		StressTestConcurrency: getEnvAsInt("STRESS_TEST_CONCURRENCY", 1),
+		StressTestMaxQueue:    getEnvAsInt("STRESS_TEST_MAX_QUEUE", 20),
 
-		ShortenerCap:    getEnvAsInt("SHORTENER_CAP", 100000),
-		ShortenerTTL:    getEnvAsDuration("SHORTENER_TTL_HOURS", time.Hour),
-		ShortCodeLength: getEnvAsInt("SHORT_CODE_LENGTH", 4),
-		MaxUrlLength:    getEnvAsInt("MAX_URL_LENGTH", 4096),
+		LimiterSnapshotPath: getEnv("LIMITER_SNAPSHOT_PATH", "limiter_snapshot.json"),
+
+		NamedLimitsPath: getEnv("NAMED_LIMITS_PATH", "limits.json"),
+		RateLimitApiKey: getEnv("RATELIMIT_API_KEY", ""),
+
+		RlsAddr:       getEnv("RLS_ADDR", ""),
+		RlsConfigPath: getEnv("RLS_CONFIG_PATH", "rls_config.json"),
 
 		Fallback404HTML: getEnv("FALLBACK_404_HTML", "<h1>Short link not found</h1><p>It seems this short link has expired or never existed.</p><a href='/'>Go to homepage</a>"),
 	}, nil
@@ -116,6 +252,16 @@ func getEnvAsInt(key string, fallback int) int {
 	return fallback
 }
 
+func getEnvAsBool(key string, fallback bool) bool {
+	if valueStr, ok := os.LookupEnv(key); ok {
+		value, err := strconv.ParseBool(valueStr)
+		if err == nil {
+			return value
+		}
+	}
+	return fallback
+}
+
 func getEnvAsDuration(key string, fallback time.Duration) time.Duration {
 	if valueStr, ok := os.LookupEnv(key); ok {
 		seconds, err := strconv.Atoi(valueStr)
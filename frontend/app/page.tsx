@@ -12,6 +12,19 @@ export interface Metrics {
   globalTokensUsed: number;
   activeUsers: number;
   currentUrlCount: number;
+  globalAllowedPerSec: number;
+  globalRejectedPerSec: number;
+  perClientAllowedPerSec: number;
+  perClientRejectedPerSec: number;
+  topRejectedClients: { clientId: string; count: number }[];
+  shadowGlobalRejectedPerSec: number;
+  shadowPerClientRejectedPerSec: number;
+  topShadowRejectedClients: { clientId: string; count: number }[];
+  shortensPerSec: number;
+  redirectsPerSec: number;
+  latencyP50Ms: number;
+  latencyP99Ms: number;
+  timestamp: string;
 }
 
 export default function Page() {
@@ -21,6 +34,19 @@ export default function Page() {
     globalTokensUsed: 0,
     activeUsers: 0,
     currentUrlCount: 0,
+    globalAllowedPerSec: 0,
+    globalRejectedPerSec: 0,
+    perClientAllowedPerSec: 0,
+    perClientRejectedPerSec: 0,
+    topRejectedClients: [],
+    shadowGlobalRejectedPerSec: 0,
+    shadowPerClientRejectedPerSec: 0,
+    topShadowRejectedClients: [],
+    shortensPerSec: 0,
+    redirectsPerSec: 0,
+    latencyP50Ms: 0,
+    latencyP99Ms: 0,
+    timestamp: "",
   });
 
   return (
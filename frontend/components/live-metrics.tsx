@@ -15,16 +15,18 @@ export default function LiveMetrics({ metrics, setMetrics }: LiveMetricsProps) {
   useEffect(() => {
     const evtSource = new EventSource(`${BASE_URL}/api/metrics/stream`);
 
-    evtSource.onmessage = ({ isTrusted, data }) => {
+    // replayed points arrive first after a reconnect, each one is a full snapshot
+    evtSource.addEventListener("metrics", ({ isTrusted, data }) => {
       if (isTrusted && data) {
         const parsedData: Metrics = JSON.parse(data);
         if (parsedData) setMetrics({ ...parsedData });
       }
-    };
+    });
 
+    // left open: EventSource reconnects on its own and sends Last-Event-ID so
+    // the server can replay the points that were missed
     evtSource.onerror = (err) => {
       process.env.NODE_ENV != "production" && console.error("SSE error:", err);
-      evtSource.close();
     };
 
     return () => {
@@ -94,6 +96,80 @@ export default function LiveMetrics({ metrics, setMetrics }: LiveMetricsProps) {
           </CardContent>
         </Card>
       </div>
+      <div className="mt-4 grid gap-4 md:grid-cols-3">
+        {/* Throughput Card */}
+        <Card>
+          <CardHeader>
+            <CardTitle className="text-base text-center">Throughput</CardTitle>
+          </CardHeader>
+          <CardContent className="space-y-1 text-sm text-muted-foreground">
+            <p>
+              Global: {metrics.globalAllowedPerSec.toFixed(1)} allowed /{" "}
+              {metrics.globalRejectedPerSec.toFixed(1)} rejected per second
+            </p>
+            <p>
+              Per client: {metrics.perClientAllowedPerSec.toFixed(1)} allowed /{" "}
+              {metrics.perClientRejectedPerSec.toFixed(1)} rejected per second
+            </p>
+            <p>
+              {metrics.shortensPerSec.toFixed(1)} shortens /{" "}
+              {metrics.redirectsPerSec.toFixed(1)} redirects per second
+            </p>
+          </CardContent>
+        </Card>
+
+        {/* Latency Card */}
+        <Card>
+          <CardHeader>
+            <CardTitle className="text-base text-center">Latency</CardTitle>
+          </CardHeader>
+          <CardContent className="flex flex-col items-center justify-center">
+            <p className="text-4xl font-bold text-primary">
+              {metrics.latencyP50Ms.toFixed(1)} ms
+            </p>
+            <p className="mt-2 text-sm text-muted-foreground">
+              p50, p99 at {metrics.latencyP99Ms.toFixed(1)} ms
+            </p>
+          </CardContent>
+        </Card>
+
+        {/* Top Rejected Clients Card */}
+        <Card>
+          <CardHeader>
+            <CardTitle className="text-base text-center">
+              Top Rejected Clients
+            </CardTitle>
+          </CardHeader>
+          <CardContent className="text-sm text-muted-foreground">
+            {metrics.topRejectedClients.length === 0 ? (
+              <p className="text-center">No rejections in the last second</p>
+            ) : (
+              <ul className="space-y-1">
+                {metrics.topRejectedClients.map(({ clientId, count }) => (
+                  <li key={clientId} className="flex justify-between gap-2">
+                    <span className="truncate">{clientId}</span>
+                    <span>{count}</span>
+                  </li>
+                ))}
+              </ul>
+            )}
+            {metrics.shadowGlobalRejectedPerSec +
+              metrics.shadowPerClientRejectedPerSec >
+              0 && (
+              <p className="mt-2 text-center text-xs">
+                Shadow limits would reject{" "}
+                {(
+                  metrics.shadowGlobalRejectedPerSec +
+                  metrics.shadowPerClientRejectedPerSec
+                ).toFixed(1)}
+                /s
+                {metrics.topShadowRejectedClients.length > 0 &&
+                  `, mostly ${metrics.topShadowRejectedClients[0].clientId}`}
+              </p>
+            )}
+          </CardContent>
+        </Card>
+      </div>
     </div>
   );
 }
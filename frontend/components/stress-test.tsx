@@ -5,6 +5,56 @@ import { useEffect, useState } from "react";
 import { BASE_URL } from "@/lib/utils";
 import { EventSourcePolyfill } from "event-source-polyfill";
 
+interface LoadScenario {
+  name: string;
+  method: string;
+  path: string;
+  concurrency: number;
+  requests?: number;
+  duration?: string;
+  rate?: number;
+}
+
+interface LoadProgress {
+  scenario: string;
+  second: number;
+  completed: number;
+  requestsPerSec: number;
+  statusCounts: Record<string, number>;
+  errors: number;
+}
+
+interface LoadSummary {
+  scenario: string;
+  requests: number;
+  errors: number;
+  durationMs: number;
+  requestsPerSec: number;
+  statusCounts: Record<string, number>;
+  latency: { p50Ms: number; p90Ms: number; p99Ms: number; maxMs: number };
+}
+
+interface StepReport {
+  name: string;
+  passed: boolean;
+  expectations: { expectation: string; actual: number; passed: boolean }[];
+  regressions?: string[];
+}
+
+interface StressTestDone {
+  report: string;
+  passed: boolean;
+  steps: number;
+  regressions: number;
+  jsonUrl: string;
+  htmlUrl: string;
+}
+
+const formatStatusCounts = (counts: Record<string, number>) =>
+  Object.entries(counts)
+    .map(([status, count]) => `[${status}] ${count}`)
+    .join("  ");
+
 enum StressTestStatus {
   DONE,
   RUNNING,
@@ -40,12 +90,47 @@ export default function StressTest() {
       );
       setEvtSource(evtSource);
 
-      evtSource.onmessage = (e) => {
-        if (e.data) {
-          const parsedData = JSON.parse(e.data);
-          setStressTestOutput((prev) => prev + "\n" + parsedData.outputLine);
-        }
-      };
+      const appendLine = (line: string) =>
+        setStressTestOutput((prev) => prev + "\n" + line);
+
+      evtSource.addEventListener("queue", (e) => {
+        const { position }: { position: number } = JSON.parse(
+          (e as MessageEvent).data,
+        );
+        appendLine(
+          `Another stress test is running, you are number ${position} in line...`,
+        );
+      });
+
+      evtSource.addEventListener("scenario", (e) => {
+        const scenario: LoadScenario = JSON.parse((e as MessageEvent).data);
+        appendLine(`\n--- ${scenario.name} ---`);
+        appendLine(
+          `${scenario.method} ${scenario.path}, ${scenario.concurrency} workers` +
+            (scenario.requests ? `, ${scenario.requests} requests` : "") +
+            (scenario.duration ? `, for ${scenario.duration}` : "") +
+            (scenario.rate ? `, at ${scenario.rate} req/s` : ""),
+        );
+      });
+
+      evtSource.addEventListener("progress", (e) => {
+        const progress: LoadProgress = JSON.parse((e as MessageEvent).data);
+        appendLine(
+          `  ${progress.second}s: ${progress.completed} done, ${progress.requestsPerSec} req/s ${formatStatusCounts(progress.statusCounts)}`,
+        );
+      });
+
+      evtSource.addEventListener("summary", (e) => {
+        const summary: LoadSummary = JSON.parse((e as MessageEvent).data);
+        appendLine(
+          `  ${summary.requests} responses in ${summary.durationMs}ms (${summary.requestsPerSec.toFixed(0)} req/s)`,
+        );
+        appendLine(`  Status: ${formatStatusCounts(summary.statusCounts)}`);
+        if (summary.errors) appendLine(`  Errors: ${summary.errors}`);
+        appendLine(
+          `  Latency: p50 ${summary.latency.p50Ms}ms, p90 ${summary.latency.p90Ms}ms, p99 ${summary.latency.p99Ms}ms, max ${summary.latency.maxMs}ms`,
+        );
+      });
 
       evtSource.addEventListener("error", (e) => {
         const { data } = e as MessageEvent;
@@ -62,12 +147,23 @@ export default function StressTest() {
 
       evtSource.onerror = (e) => console.log(e);
 
+      evtSource.addEventListener("step", (e) => {
+        const step: StepReport = JSON.parse((e as MessageEvent).data);
+        step.expectations.forEach(({ expectation, actual, passed }) =>
+          appendLine(`  ${passed ? "PASS" : "FAIL"} ${expectation} (got ${actual})`),
+        );
+        step.regressions?.forEach((regression) =>
+          appendLine(`  REGRESSION ${regression}`),
+        );
+      });
+
       evtSource.addEventListener("done", (e) => {
-        const { data } = e as MessageEvent;
-        if (data) {
-          const parsedData = JSON.parse(data);
-          setStressTestOutput((prev) => prev + "\n" + parsedData.outputLine);
-        }
+        const done: StressTestDone = JSON.parse((e as MessageEvent).data);
+        appendLine(
+          `\n${done.passed ? "All steps passed." : "Some steps failed."}` +
+            (done.regressions ? ` ${done.regressions} regression(s) flagged.` : ""),
+        );
+        appendLine(`Report: ${BASE_URL}${done.htmlUrl}`);
         setStressTestStatus(StressTestStatus.DONE);
         evtSource.close();
       });
@@ -1,29 +1,105 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
-	"os/exec"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/dessources/go_rate_limiter/ratelimit"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// bcrypt ignores anything past 72 bytes
+const maxLinkPasswordLength = 72
+
+const shortenerFullMessage = "We can't store any more links right now. Please try again later."
+
+const invalidRedirectStatusMessage = "Redirect status must be one of 301, 302, 307 or 308"
+
 type UrlShortenerPayload struct {
-	Original string `json:"original"`
+	Original       string `json:"original"`
+	Password       string `json:"password,omitempty"`
+	RedirectStatus int    `json:"redirectStatus,omitempty"` // 301, 302, 307 or 308
+}
+
+type BatchShortenItem struct {
+	Original       string `json:"original"`
+	Alias          string `json:"alias,omitempty"`
+	RedirectStatus int    `json:"redirectStatus,omitempty"`
+}
+
+type BatchShortenPayload struct {
+	Items []BatchShortenItem `json:"items"`
+}
+
+type BatchShortenResult struct {
+	Original     string             `json:"original"`
+	ShortCode    string             `json:"shortCode,omitempty"`
+	Status       int                `json:"status"`
+	ErrorMessage string             `json:"errorMessage,omitempty"`
+	Reason       UrlRejectionReason `json:"reason,omitempty"`
+	Evicted      string             `json:"evicted,omitempty"` // live code dropped to make room
 }
 
 type ErrorResponse struct {
 	ErrorMessage string `json:"errorMessage"`
 }
 
+type RateLimitPayload struct {
+	Key   string `json:"key"`
+	Limit string `json:"limit"`
+	Cost  int    `json:"cost,omitempty"` // defaults to 1
+}
+
+type RateLimitDecision struct {
+	Allowed    bool      `json:"allowed"`
+	Limit      int       `json:"limit"`
+	Remaining  int       `json:"remaining"`
+	ResetAt    time.Time `json:"resetAt"`
+	RetryAfter int       `json:"retryAfter"` // seconds, 0 when allowed
+}
+
+type StressTestDone struct {
+	Report      string `json:"report"`
+	Passed      bool   `json:"passed"`
+	Steps       int    `json:"steps"`
+	Regressions int    `json:"regressions"`
+	JsonUrl     string `json:"jsonUrl"`
+	HtmlUrl     string `json:"htmlUrl"`
+}
+
 type Metrics struct {
 	GlobalTokenBucketCap int `json:"globalTokenBucketCap"`
 	GlobalTokensUsed     int `json:"globalTokensUsed"`
 	ActiveUsers          int `json:"activeUsers"`
 	CurrentUrlCount      int `json:"currentUrlCount"`
+
+	// rates are averaged over the last tick
+	GlobalAllowedPerSec     float64            `json:"globalAllowedPerSec"`
+	GlobalRejectedPerSec    float64            `json:"globalRejectedPerSec"`
+	PerClientAllowedPerSec  float64            `json:"perClientAllowedPerSec"`
+	PerClientRejectedPerSec float64            `json:"perClientRejectedPerSec"`
+	TopRejectedClients      []ClientRejections `json:"topRejectedClients"`
+	// would-be rejections of shadow limiters, see GLOBAL_LIMITER_SHADOW and SHADOW_PER_CLIENT_LIMITER_LIMIT
+	ShadowGlobalRejectedPerSec    float64            `json:"shadowGlobalRejectedPerSec"`
+	ShadowPerClientRejectedPerSec float64            `json:"shadowPerClientRejectedPerSec"`
+	TopShadowRejectedClients      []ClientRejections `json:"topShadowRejectedClients"`
+	ShortensPerSec                float64            `json:"shortensPerSec"`
+	RedirectsPerSec               float64            `json:"redirectsPerSec"`
+	LatencyP50Ms                  float64            `json:"latencyP50Ms"`
+	LatencyP99Ms                  float64            `json:"latencyP99Ms"`
+	Timestamp                     time.Time          `json:"timestamp"`
 }
 
 //--------- Index route -------------------
@@ -41,27 +117,41 @@ type App struct {
 	logger               *slog.Logger
 	page404HTMLText      string
 	shortener            UrlShortener
-	globalRateLimiter    *GlobalRateLimiter
-	perClientRateLimiter *PerClientRateLimiter
+	globalRateLimiter    *ratelimit.GlobalRateLimiter
+	perClientRateLimiter *ratelimit.PerClientRateLimiter
+	// tries SHADOW_PER_CLIENT_LIMITER_LIMIT out, nil when disabled
+	shadowPerClientRateLimiter *ratelimit.PerClientRateLimiter
+	passwordAttemptLimiter     *ratelimit.PerClientRateLimiter
+	metrics                    *MetricsRecorder
+	metricsHub                 *MetricsHub
+	stressTestQueue            *RunQueue
+	namedLimiters              map[string]*ratelimit.PerClientRateLimiter // served by /api/ratelimit
+	accessLists                *AccessLists
 }
 
 func (app *App) RetrieveUrl(w http.ResponseWriter, r *http.Request) {
 	short := r.PathValue("shortUrl")
 
+	// "/abc+" or "/abc?preview" shows where a link goes instead of following it
+	short, preview := strings.CutSuffix(short, "+")
+	preview = preview || r.URL.Query().Has("preview")
+
 	if short != "" {
-		original, err := app.shortener.RetrieveUrl(short)
+		mapping, err := app.shortener.RetrieveUrl(short)
 		if err != nil {
 			app.logger.Info("short URL not found", "short_url", short, "error", err)
-			w.Header().Add("Content-Type", "text/html")
-			w.WriteHeader(http.StatusNotFound)
-			if app.page404HTMLText != "" {
-				fmt.Fprintf(w, "%s", app.page404HTMLText)
-			} else {
-				fmt.Fprintf(w, app.cfg.Fallback404HTML)
-			}
+			app.writeNotFoundPage(w)
+		} else if preview {
+			app.logger.Info("serving link preview", "short_url", short)
+			app.writeLinkPreview(w, short, mapping)
+		} else if mapping.passwordHash != nil {
+			app.logger.Info("serving password prompt", "short_url", short)
+			app.writePasswordPrompt(w, http.StatusOK, short, "")
 		} else {
-			app.logger.Info("redirecting short URL", "short_url", short, "original_url", original)
-			http.Redirect(w, r, original, http.StatusTemporaryRedirect)
+			app.logger.Info("redirecting short URL", "short_url", short, "original_url", mapping.originalUrl, "status", mapping.RedirectStatus())
+			app.shortener.RecordClick(short)
+			app.metrics.Redirected()
+			http.Redirect(w, r, mapping.originalUrl, mapping.RedirectStatus())
 		}
 	} else {
 		app.logger.Info("redirecting root to homepage")
@@ -70,6 +160,83 @@ func (app *App) RetrieveUrl(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// UnlockUrl checks the password submitted from the prompt of a protected link.
+func (app *App) UnlockUrl(w http.ResponseWriter, r *http.Request) {
+	short := r.PathValue("shortUrl")
+
+	mapping, err := app.shortener.RetrieveUrl(short)
+	if err != nil || mapping.passwordHash == nil {
+		app.logger.Info("unlock requested for unknown or unprotected short URL", "short_url", short)
+		app.writeNotFoundPage(w)
+		return
+	}
+
+	// attempts are counted per code, whoever makes them
+	if err := app.passwordAttemptLimiter.Allow(short); err != nil {
+		app.logger.Warn("too many password attempts", "short_url", short, "remote_addr", r.RemoteAddr)
+		app.writePasswordPrompt(w, http.StatusTooManyRequests, short, "Too many attempts. Please try again later.")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1024)
+	password := r.PostFormValue("password")
+	if bcrypt.CompareHashAndPassword(mapping.passwordHash, []byte(password)) != nil {
+		app.logger.Info("incorrect password for protected short URL", "short_url", short, "remote_addr", r.RemoteAddr)
+		app.writePasswordPrompt(w, http.StatusUnauthorized, short, "Incorrect password.")
+		return
+	}
+
+	app.logger.Info("redirecting protected short URL", "short_url", short, "original_url", mapping.originalUrl)
+	app.shortener.RecordClick(short)
+	app.metrics.Redirected()
+	// 303 so the browser follows up with a GET on the destination
+	http.Redirect(w, r, mapping.originalUrl, http.StatusSeeOther)
+}
+
+func (app *App) writeNotFoundPage(w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(http.StatusNotFound)
+	if app.page404HTMLText != "" {
+		fmt.Fprintf(w, "%s", app.page404HTMLText)
+	} else {
+		fmt.Fprintf(w, "%s", app.cfg.Fallback404HTML)
+	}
+}
+
+func (app *App) writeLinkPreview(w http.ResponseWriter, short string, mapping UrlMapping) {
+	page := &LinkPreviewPage{
+		ShortUrl:          strings.TrimSuffix(app.cfg.baseUrl, "/") + "/" + short,
+		ShortCode:         short,
+		PasswordProtected: mapping.passwordHash != nil,
+		RedirectStatus:    mapping.RedirectStatus(),
+		RedirectType:      http.StatusText(mapping.RedirectStatus()),
+		CreatedAt:         mapping.createdAt,
+		ExpiresAt:         mapping.expiresAt,
+	}
+	if !page.PasswordProtected {
+		page.Destination = mapping.originalUrl
+		if u, err := url.Parse(mapping.originalUrl); err == nil {
+			page.DestinationHost = u.Hostname()
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := linkPreviewTemplate.Execute(w, page); err != nil {
+		app.logger.Error("failed to render link preview", "short_url", short, "error", err)
+	}
+}
+
+func (app *App) writePasswordPrompt(w http.ResponseWriter, status int, short, errorMessage string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := passwordPromptTemplate.Execute(w, &PasswordPromptPage{short, errorMessage}); err != nil {
+		app.logger.Error("failed to render password prompt", "short_url", short, "error", err)
+	}
+}
+
 func (app *App) ShortenUrl(w http.ResponseWriter, r *http.Request) {
 	var payload UrlShortenerPayload
 	errorMessage := ""
@@ -80,23 +247,58 @@ func (app *App) ShortenUrl(w http.ResponseWriter, r *http.Request) {
 		errorMessage = "Oops, we couldn't process your request. Please try again later."
 		json.NewEncoder(w).Encode(&ErrorResponse{errorMessage})
 		return
-	} else if message, ok := ValidateUrl(payload.Original, app.cfg); !ok {
-		app.logger.Warn("bad request: invalid URL", "url", payload.Original, "validation_message", message)
+	} else if rejection, ok := ValidateUrl(payload.Original, app.cfg); !ok {
+		app.logger.Warn("bad request: invalid URL", "url", payload.Original, "validation_message", rejection.ErrorMessage, "reason", rejection.Reason)
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(&ErrorResponse{message})
+		json.NewEncoder(w).Encode(rejection)
+		return
+	} else if len(payload.Password) > maxLinkPasswordLength {
+		app.logger.Warn("bad request: link password too long", "length", len(payload.Password))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ErrorResponse{fmt.Sprintf("Password may not exceed %d characters", maxLinkPasswordLength)})
+		return
+	} else if !IsValidRedirectStatus(payload.RedirectStatus) {
+		app.logger.Warn("bad request: invalid redirect status", "redirect_status", payload.RedirectStatus)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ErrorResponse{invalidRedirectStatusMessage})
 		return
 	} else {
-		shortUrl, err := Shorten(app.shortener, payload.Original)
-		if err != nil {
+		mapping := UrlMapping{originalUrl: payload.Original, owner: r.Header.Get("X-API-Key"), redirectStatus: payload.RedirectStatus}
+		if payload.Password != "" {
+			if mapping.passwordHash, err = bcrypt.GenerateFromPassword([]byte(payload.Password), bcrypt.DefaultCost); err != nil {
+				app.logger.Error("failed to hash link password", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(&ErrorResponse{"Something broke on our end. Please try again later."})
+				return
+			}
+		}
+
+		shortUrl, added, err := Shorten(app.shortener, mapping)
+		if errors.Is(err, ErrShortenerFull) {
+			app.logger.Warn("shortener is full, rejecting new URL", "original_url", payload.Original)
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(&ErrorResponse{shortenerFullMessage})
+			return
+		} else if err != nil {
 			app.logger.Error("failed to shorten URL", "original_url", payload.Original, "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			errorMessage = "Something broke on our end. Please try again later."
 			json.NewEncoder(w).Encode(&ErrorResponse{errorMessage})
 			return
 		} else {
-			app.logger.Info("URL shortened successfully", "original_url", payload.Original, "short_url", shortUrl)
+			app.metrics.Shortened(1)
+			if added.Evicted != "" {
+				app.logger.Info("evicted short URL to make room", "evicted_short_url", added.Evicted, "short_url", shortUrl)
+			}
 			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusCreated)
+			if added.Existing != "" {
+				app.logger.Info("returning existing short URL", "original_url", payload.Original, "short_url", shortUrl)
+				w.WriteHeader(http.StatusOK)
+			} else {
+				app.logger.Info("URL shortened successfully", "original_url", payload.Original, "short_url", shortUrl)
+				w.WriteHeader(http.StatusCreated)
+			}
 
 			response := map[string]string{
 				"shortCode": shortUrl,
@@ -107,46 +309,408 @@ func (app *App) ShortenUrl(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func (app *App) ShortenBatch(w http.ResponseWriter, r *http.Request) {
+	var payload BatchShortenPayload
+	w.Header().Set("Content-Type", "application/json")
+
+	// generous upper bound: every item at max url & alias length plus JSON overhead
+	maxBodySize := int64(app.cfg.MaxBatchSize) * int64(app.cfg.MaxUrlLength+app.cfg.MaxAliasLength+64)
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&payload); err != nil {
+		app.logger.Warn("bad request: failed to decode batch shorten payload", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ErrorResponse{"Oops, we couldn't process your request. Please try again later."})
+		return
+	}
+
+	if len(payload.Items) == 0 || len(payload.Items) > app.cfg.MaxBatchSize {
+		app.logger.Warn("bad request: invalid batch size", "size", len(payload.Items))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ErrorResponse{fmt.Sprintf("A batch must contain between 1 and %d urls", app.cfg.MaxBatchSize)})
+		return
+	}
+
+	clientId, ok := app.cfg.ClientMask.ClientId(r)
+	if !ok {
+		app.logger.Warn("invalid API key provided", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(&ErrorResponse{"Invalid API key provided."})
+		return
+	}
+
+	// the whole batch counts against the client's window, item by item
+	if !isExemptFromLimits(r) && !app.allowBatch(w, clientId, len(payload.Items)) {
+		return
+	}
+
+	// hosts are looked up concurrently and once each, rather than item by item
+	originals := make([]string, len(payload.Items))
+	for i, item := range payload.Items {
+		originals[i] = item.Original
+	}
+	resolved := app.cfg.urlPolicy.ResolveHosts(r.Context(), originals)
+
+	owner := r.Header.Get("X-API-Key")
+	results := make([]BatchShortenResult, len(payload.Items))
+	shortened := 0
+	for i, item := range payload.Items {
+		results[i] = app.shortenBatchItem(item, owner, resolved)
+		if results[i].ShortCode != "" {
+			shortened++
+		}
+	}
+	app.metrics.Shortened(shortened)
+
+	app.logger.Info("batch shortened", "client_id", clientId, "size", len(payload.Items))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]BatchShortenResult{"results": results})
+}
+
+// allowBatch debits size requests from the client's window, and answers with
+// a 429 when they don't fit. The shadow limiter is debited too but never refuses.
+func (app *App) allowBatch(w http.ResponseWriter, clientId string, size int) bool {
+	if app.shadowPerClientRateLimiter != nil {
+		if err := app.shadowPerClientRateLimiter.AllowN(clientId, size); err != nil {
+			app.logger.Info("shadow per-client rate limit exceeded for batch", "client_id", clientId, "size", size, "limit", app.cfg.ShadowPerClientLimiterLimit, "error", err)
+			app.metrics.PerClientShadowRejected(clientId)
+		}
+	}
+
+	err := app.perClientRateLimiter.AllowN(clientId, size)
+	if app.cfg.PerClientLimiterShadow {
+		if err != nil {
+			app.logger.Info("shadow per-client rate limit exceeded for batch", "client_id", clientId, "size", size, "error", err)
+			app.metrics.PerClientShadowRejected(clientId)
+		}
+		err = nil
+	} else {
+		app.metrics.PerClientLimit(clientId, err == nil)
+	}
+	if err != nil {
+		errorMessage := "Rate limit exceeded. Please try again later"
+		if errors.Is(err, ratelimit.ErrStoreFull) {
+			errorMessage = "We are a bit busy right now. Please try again later."
+		}
+		app.logger.Warn("per-client rate limit exceeded for batch", "client_id", clientId, "size", size, "error", err)
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(&ErrorResponse{errorMessage})
+		return false
+	}
+	return true
+}
+
+func (app *App) shortenBatchItem(item BatchShortenItem, owner string, resolved HostResolutions) BatchShortenResult {
+	result := BatchShortenResult{Original: item.Original}
+
+	if rejection, ok := ValidateResolvedUrl(item.Original, app.cfg, resolved); !ok {
+		result.Status = http.StatusBadRequest
+		result.ErrorMessage = rejection.ErrorMessage
+		result.Reason = rejection.Reason
+		return result
+	}
+
+	if !IsValidRedirectStatus(item.RedirectStatus) {
+		result.Status = http.StatusBadRequest
+		result.ErrorMessage = invalidRedirectStatusMessage
+		return result
+	}
+
+	mapping := UrlMapping{originalUrl: item.Original, owner: owner, redirectStatus: item.RedirectStatus}
+
+	if item.Alias != "" {
+		if message, ok := ValidateAlias(item.Alias, app.cfg); !ok {
+			result.Status = http.StatusBadRequest
+			result.ErrorMessage = message
+			return result
+		}
+
+		evicted, err := ShortenWithAlias(app.shortener, item.Alias, mapping)
+		if errors.Is(err, ErrAliasTaken) {
+			result.Status = http.StatusConflict
+			result.ErrorMessage = err.Error()
+		} else if errors.Is(err, ErrShortenerFull) {
+			result.Status = http.StatusServiceUnavailable
+			result.ErrorMessage = shortenerFullMessage
+		} else if err != nil {
+			app.logger.Error("failed to shorten URL with alias", "original_url", item.Original, "alias", item.Alias, "error", err)
+			result.Status = http.StatusInternalServerError
+			result.ErrorMessage = "Something broke on our end. Please try again later."
+		} else {
+			result.Status = http.StatusCreated
+			result.ShortCode = item.Alias
+			result.Evicted = evicted
+		}
+		return result
+	}
+
+	shortUrl, added, err := Shorten(app.shortener, mapping)
+	if errors.Is(err, ErrShortenerFull) {
+		result.Status = http.StatusServiceUnavailable
+		result.ErrorMessage = shortenerFullMessage
+		return result
+	} else if err != nil {
+		app.logger.Error("failed to shorten URL", "original_url", item.Original, "error", err)
+		result.Status = http.StatusInternalServerError
+		result.ErrorMessage = "Something broke on our end. Please try again later."
+		return result
+	}
+
+	result.ShortCode = shortUrl
+	result.Evicted = added.Evicted
+	if added.Existing != "" {
+		result.Status = http.StatusOK
+	} else {
+		result.Status = http.StatusCreated
+	}
+	return result
+}
+
+func (app *App) QRCode(w http.ResponseWriter, r *http.Request) {
+	short := r.PathValue("shortUrl")
+
+	if _, err := app.shortener.RetrieveUrl(short); err != nil {
+		app.logger.Info("QR code requested for unknown short URL", "short_url", short)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&ErrorResponse{"Short link not found."})
+		return
+	}
+
+	opts, message, ok := ParseQROptions(r.URL.Query(), app.cfg)
+	if !ok {
+		app.logger.Warn("bad request: invalid QR code options", "short_url", short, "validation_message", message)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ErrorResponse{message})
+		return
+	}
+
+	data, contentType, err := RenderQRCode(strings.TrimSuffix(app.cfg.baseUrl, "/")+"/"+short, opts)
+	if errors.Is(err, ErrQRSizeTooSmall) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ErrorResponse{err.Error()})
+		return
+	} else if err != nil {
+		app.logger.Error("failed to render QR code", "short_url", short, "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(&ErrorResponse{"Something broke on our end. Please try again later."})
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (app *App) ExportMappings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"mappings-%s.jsonl\"", time.Now().UTC().Format("20060102-150405")))
+	w.WriteHeader(http.StatusOK)
+
+	count, err := ExportMappings(app.shortener, w)
+	if err != nil {
+		// headers are gone, the client sees a truncated file
+		app.logger.Error("mapping export interrupted", "exported", count, "error", err)
+		return
+	}
+	app.logger.Info("mappings exported", "exported", count, "remote_addr", r.RemoteAddr)
+}
+
+func (app *App) ImportMappings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	policy, ok := ParseConflictPolicy(r.URL.Query().Get("onConflict"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ErrorResponse{"onConflict must be one of skip, overwrite or fail"})
+		return
+	}
+
+	summary, err := ImportMappings(app.shortener, http.MaxBytesReader(w, r.Body, app.cfg.MaxImportSize), policy, app.cfg)
+	if err != nil {
+		app.logger.Warn("bad request: failed to read mapping import", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ErrorResponse{fmt.Sprintf("Could not read import file: %v", err)})
+		return
+	}
+
+	app.logger.Info("mappings imported", "policy", policy, "imported", summary.Imported, "overwritten", summary.Overwritten,
+		"skipped", summary.Skipped, "expired", summary.Expired, "invalid", summary.Invalid, "aborted", summary.Aborted)
+	if summary.Aborted {
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(&summary)
+}
+
+func (app *App) GetAccessLists(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(app.accessLists.Config())
+}
+
+// SetAccessLists replaces both lists, entries left out are removed.
+func (app *App) SetAccessLists(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var config AccessListsConfig
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		app.logger.Warn("bad request: failed to decode access lists", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ErrorResponse{"Access lists must be a JSON object with allow and deny lists."})
+		return
+	}
+	if err := app.accessLists.Set(config); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ErrorResponse{err.Error()})
+		return
+	}
+
+	config = app.accessLists.Config()
+	app.logger.Info("access lists updated", "remote_addr", r.RemoteAddr,
+		"allowed_cidrs", len(config.Allow.Cidrs), "allowed_api_keys", len(config.Allow.ApiKeys),
+		"denied_cidrs", len(config.Deny.Cidrs), "denied_api_keys", len(config.Deny.ApiKeys))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(config)
+}
+
+//------- rate limit decision routes ---------------
+
+const maxRateLimitKeyLength = 256
+
+// CheckRateLimit answers whether a request would be allowed, without counting it.
+func (app *App) CheckRateLimit(w http.ResponseWriter, r *http.Request) {
+	app.decideRateLimit(w, r, false)
+}
+
+// ConsumeRateLimit counts a request against a named limit when it is allowed.
+func (app *App) ConsumeRateLimit(w http.ResponseWriter, r *http.Request) {
+	app.decideRateLimit(w, r, true)
+}
+
+func (app *App) decideRateLimit(w http.ResponseWriter, r *http.Request, consume bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var payload RateLimitPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&payload); err != nil {
+		app.logger.Warn("bad request: failed to decode rate limit payload", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ErrorResponse{"Oops, we couldn't process your request. Please try again later."})
+		return
+	}
+	if payload.Cost == 0 {
+		payload.Cost = 1
+	}
+	if payload.Key == "" || len(payload.Key) > maxRateLimitKeyLength || payload.Cost < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ErrorResponse{fmt.Sprintf("A key of at most %d characters and a positive cost are required.", maxRateLimitKeyLength)})
+		return
+	}
+
+	limiter, ok := app.namedLimiters[payload.Limit]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&ErrorResponse{fmt.Sprintf("Unknown limit %q.", payload.Limit)})
+		return
+	}
+
+	var decision ratelimit.Decision
+	var err error
+	if consume {
+		decision, err = limiter.Consume(payload.Key, payload.Cost)
+	} else {
+		decision, err = limiter.Check(payload.Key, payload.Cost)
+	}
+	switch {
+	case errors.Is(err, ratelimit.ErrCostExceedsLimit):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&ErrorResponse{fmt.Sprintf("Cost exceeds the limit of %d.", limiter.Limit())})
+		return
+	case errors.Is(err, ratelimit.ErrStoreFull):
+		app.logger.Warn("named limit storage full", "limit", payload.Limit, "key", payload.Key)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(&ErrorResponse{"We are a bit busy right now. Please try again later."})
+		return
+	case err != nil:
+		app.logger.Error("failed to evaluate named limit", "limit", payload.Limit, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(&ErrorResponse{"Something broke on our end. Please try again later."})
+		return
+	}
+
+	if consume && !decision.Allowed {
+		app.logger.Info("named limit exceeded", "limit", payload.Limit, "key", payload.Key, "cost", payload.Cost)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&RateLimitDecision{
+		Allowed:    decision.Allowed,
+		Limit:      decision.Limit,
+		Remaining:  decision.Remaining,
+		ResetAt:    decision.ResetAt.UTC(),
+		RetryAfter: int(math.Ceil(decision.RetryAfter.Seconds())),
+	})
+}
+
 func (app *App) StreamMetrics(w http.ResponseWriter, r *http.Request) {
-	app.logger.Info("client connected to metrics stream", "remote_addr", r.RemoteAddr)
-	defer app.logger.Info("client disconnected from metrics stream", "remote_addr", r.RemoteAddr)
+	streamMetrics(app.logger, app.metricsHub, w, r)
+}
+
+// streamMetrics sends hub's points to r's client until it disconnects.
+func streamMetrics(logger *slog.Logger, hub *MetricsHub, w http.ResponseWriter, r *http.Request) {
+	logger.Info("client connected to metrics stream", "remote_addr", r.RemoteAddr)
+	defer logger.Info("client disconnected from metrics stream", "remote_addr", r.RemoteAddr)
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		app.logger.Error("metrics streaming unsupported: http.Flusher not implemented", "remote_addr", r.RemoteAddr)
+		logger.Error("metrics streaming unsupported: http.Flusher not implemented", "remote_addr", r.RemoteAddr)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(&ErrorResponse{"Metrics Streaming is currently unsupported."})
 		return
 	}
 
+	// sent by EventSource when it reconnects, so the missed points can be replayed
+	lastEventId, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	missed, updates, unsubscribe, err := hub.Subscribe(lastEventId)
+	if err != nil {
+		logger.Warn("metrics subscriber rejected", "remote_addr", r.RemoteAddr, "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(&ErrorResponse{err.Error()})
+		return
+	}
+	defer unsubscribe()
+
 	w.Header().Add("Content-Type", "text/event-stream")
 	w.Header().Add("Cache-Control", "no-cache")
 	w.Header().Add("Connection", "keep-alive")
 
-	metricsTicker := time.NewTicker(time.Second)
-	defer metricsTicker.Stop()
-	errorCount := 0
+	fmt.Fprintf(w, "retry: %d\n\n", metricsRetryMillis)
+	for _, data := range missed {
+		w.Write(data)
+	}
+	flusher.Flush()
 
 	for {
 		select {
-		case <-metricsTicker.C:
-			globalTokenBucketCap := app.globalRateLimiter.bucket.Cap()
-			globalTokensUsed := globalTokenBucketCap - app.globalRateLimiter.bucket.Len()
-			activeUsers := app.perClientRateLimiter.timeLogStore.Len()
-			currentUrlCount := app.shortener.Len()
-
-			jsonData, err := json.Marshal(&Metrics{globalTokenBucketCap, globalTokensUsed, activeUsers, currentUrlCount})
-			if err != nil {
-				app.logger.Error("failed to marshal metrics data", "error", err)
-				errorCount++
-				if errorCount > 2 {
-					SendSSEErrorEvent(w, "Metrics Streaming is currently unavailable.", flusher)
-					return
-				}
+		case data, ok := <-updates:
+			if !ok {
+				// dropped for falling behind, or the hub went offline
+				SendSSEErrorEvent(w, "Metrics stream fell behind. Please reconnect.", flusher)
+				return
 			}
 
-			fmt.Fprintf(w, "data: %s\n\n", jsonData)
+			if _, err := w.Write(data); err != nil {
+				return
+			}
 			flusher.Flush()
 
 		case <-r.Context().Done():
@@ -157,6 +721,24 @@ func (app *App) StreamMetrics(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// collectMetrics reads every gauge once, it is called by the metrics hub on each tick.
+func (app *App) collectMetrics() Metrics {
+	globalTokenBucketCap := app.globalRateLimiter.Cap()
+	globalTokensUsed := globalTokenBucketCap - app.globalRateLimiter.Tokens()
+	activeUsers := app.perClientRateLimiter.Len()
+	currentUrlCount := app.shortener.Len()
+
+	metrics := Metrics{
+		GlobalTokenBucketCap: globalTokenBucketCap,
+		GlobalTokensUsed:     globalTokensUsed,
+		ActiveUsers:          activeUsers,
+		CurrentUrlCount:      currentUrlCount,
+		Timestamp:            time.Now(),
+	}
+	app.metrics.Collect(&metrics)
+	return metrics
+}
+
 func (app *App) StressTest(w http.ResponseWriter, r *http.Request) {
 	app.logger.Info("client connected to stress test stream", "remote_addr", r.RemoteAddr)
 	defer app.logger.Info("client disconnected from stress test stream", "remote_addr", r.RemoteAddr)
@@ -174,83 +756,178 @@ func (app *App) StressTest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Cache-Control", "no-cache")
 	w.Header().Add("Connection", "keep-alive")
 
-	if testServer, testApp, err := StartTestServer(app); err != nil {
+	// a single scenario can be given in the query, otherwise a suite file runs
+	query := r.URL.Query()
+	suiteFile := query.Get("suite")
+	if suiteFile == "" {
+		suiteFile = DefaultStressSuite
+	}
+
+	var suite StressSuite
+	var err error
+	if query.Has("path") {
+		suiteFile = "custom"
+		var scenario LoadScenario
+		scenario, err = ParseLoadScenario(query)
+		suite = StressSuite{Name: "Custom scenario", Steps: []StressStep{{LoadScenario: scenario}}}
+	} else {
+		suite, err = LoadStressSuite(app.cfg.StressScenarioDir, suiteFile)
+	}
+	if err != nil {
+		app.logger.Warn("bad request: invalid stress test suite", "remote_addr", r.RemoteAddr, "suite", suiteFile, "error", err)
+		SendSSEErrorEvent(w, err.Error(), flusher)
+		return
+	}
+
+	var baseline *StressReport
+	if baselineId := query.Get("baseline"); baselineId != "" {
+		if baseline, err = LoadStressReport(app.cfg.StressReportDir, baselineId); err != nil {
+			app.logger.Warn("bad request: invalid stress test baseline", "remote_addr", r.RemoteAddr, "baseline", baselineId, "error", err)
+			SendSSEErrorEvent(w, err.Error(), flusher)
+			return
+		}
+	}
+
+	// runs are serialized so they don't skew each other's results
+	release, err := app.stressTestQueue.Acquire(r.Context(), func(position int) {
+		app.logger.Info("stress test queued", "remote_addr", r.RemoteAddr, "position", position)
+		SendSSEJSONEvent(w, "queue", map[string]int{"position": position}, flusher)
+	})
+	if errors.Is(err, ErrQueueFull) {
+		app.logger.Warn("stress test queue full", "remote_addr", r.RemoteAddr)
+		SendSSEErrorEvent(w, err.Error(), flusher)
+		return
+	} else if err != nil {
+		app.logger.Info("client left the stress test queue", "remote_addr", r.RemoteAddr)
+		return
+	}
+	defer release()
+
+	testServer, testApp, err := StartTestServer(app)
+	if err != nil {
 		app.logger.Error("failed to start test server", "error", err)
 		SendSSEErrorEvent(w, "Failed to start test server. Please try again later.", flusher)
 		return
-	} else {
-		defer testApp.shortener.Offline()
-		defer testApp.perClientRateLimiter.Offline()
-		defer testApp.globalRateLimiter.Offline()
-		defer testServer.Shutdown(context.Background())
-
-		serverStopUnexpected := make(chan struct{})
-
-		go func() {
-			app.logger.Info("test server started", "addr", app.cfg.TestServerAddr)
-			if err := testServer.ListenAndServe(); err != http.ErrServerClosed {
-				app.logger.Error("test server stopped unexpectedly", "error", err)
-				close(serverStopUnexpected)
-			}
-		}()
+	}
+	defer testApp.shortener.Offline()
+	defer testApp.passwordAttemptLimiter.Offline()
+	defer testApp.perClientRateLimiter.Offline()
+	defer testApp.globalRateLimiter.Offline()
+
+	// listening before serving means the server accepts requests as soon as this returns
+	listener, err := net.Listen("tcp", app.cfg.TestServerAddr)
+	if err != nil {
+		app.logger.Error("failed to listen for test server", "addr", app.cfg.TestServerAddr, "error", err)
+		SendSSEErrorEvent(w, "Failed to start test server. Please try again later.", flusher)
+		return
+	}
+	defer func() {
+		// in-flight requests were cancelled with ctx, don't wait on stragglers
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelShutdown()
+		if err := testServer.Shutdown(shutdownCtx); err != nil {
+			testServer.Close()
+		}
+	}()
 
-		testCommand := exec.Command("./production_stress_test.sh")
-		stdout, err := testCommand.StdoutPipe()
-		if err != nil {
-			app.logger.Error("failed to get stdout pipe for stress test command", "error", err)
-			SendSSEErrorEvent(w, "Unexpected error occured while running tests. Please try again later.", flusher)
-			return
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	go func() {
+		app.logger.Info("test server started", "addr", listener.Addr().String())
+		if err := testServer.Serve(listener); err != http.ErrServerClosed {
+			app.logger.Error("test server stopped unexpectedly", "error", err)
+			cancel()
 		}
+	}()
 
-		testCommand.Stderr = testCommand.Stdout
+	// TestServerAddr defaults to an ephemeral port, so concurrent runs never collide
+	testAddr := listener.Addr().(*net.TCPAddr)
+	if testAddr.IP.IsUnspecified() {
+		testAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: testAddr.Port}
+	}
+	baseUrl := "http://" + testAddr.String()
+	report := NewStressReport(suiteFile, suite.Name, time.Now())
+	if baseline != nil {
+		report.Baseline = baseline.Id
+	}
 
-		app.logger.Info("starting stress test command", "command", testCommand.Args)
-		if err := testCommand.Start(); err != nil {
-			app.logger.Error("failed to start stress test command", "error", err)
-			SendSSEErrorEvent(w, "Unexpected error occured while running tests. Please try again later.", flusher)
+	for _, step := range suite.Steps {
+		scenario := step.LoadScenario
+		if err := SendSSEJSONEvent(w, "scenario", &scenario, flusher); err != nil {
 			return
 		}
 
-		scanner := bufio.NewScanner(stdout)
+		client := NewLoadClient(scenario.Concurrency)
+		summary, err := RunLoad(ctx, client, baseUrl, scenario, func(progress LoadProgress) {
+			SendSSEJSONEvent(w, "progress", &progress, flusher)
+		})
+		client.CloseIdleConnections()
 
-		for scanner.Scan() {
-			select {
-			case <-r.Context().Done():
-				app.logger.Warn("client disconnected during stress test, killing test process", "remote_addr", r.RemoteAddr)
-				testCommand.Process.Kill()
-				return
-			case <-serverStopUnexpected:
+		if err != nil {
+			app.logger.Error("invalid load scenario", "scenario", scenario.Name, "error", err)
+			SendSSEErrorEvent(w, err.Error(), flusher)
+			return
+		}
+		if summary.Cancelled {
+			if r.Context().Err() != nil {
+				app.logger.Warn("client disconnected during stress test", "remote_addr", r.RemoteAddr)
+			} else {
 				app.logger.Error("test server stopped unexpectedly during stress test", "remote_addr", r.RemoteAddr)
-				SendSSEErrorEvent(w, "Test server stoped unexpectedly. Please try again later.", flusher)
-				testCommand.Process.Kill()
-				return
-			default:
-				jsonData, err := json.Marshal(map[string]string{"outputLine": scanner.Text()})
-				if err != nil {
-					app.logger.Error("failed to marshal stress test output line", "error", err)
-					SendSSEErrorEvent(w, "Unexpected error occured while reading test output. Please try again later.", flusher)
-					return
-				}
-				fmt.Fprintf(w, "data: %s\n\n", jsonData)
-				flusher.Flush()
+				SendSSEErrorEvent(w, "Test server stopped unexpectedly. Please try again later.", flusher)
 			}
+			return
 		}
 
-		if err := scanner.Err(); err != nil {
-			app.logger.Error("error while scanning stress test output", "error", err)
-			SendSSEErrorEvent(w, "Unexpected error occured while reading test output. Please try again later.", flusher)
+		stepReport := report.AddStep(step, summary, baseline)
+		app.logger.Info("stress test scenario completed", "scenario", scenario.Name, "requests", summary.Requests, "requests_per_sec", summary.RequestsPerSec, "passed", stepReport.Passed)
+		if err := SendSSEJSONEvent(w, "summary", &summary, flusher); err != nil {
 			return
 		}
-
-		if err := testCommand.Wait(); err != nil {
-			app.logger.Error("stress test command failed", "error", err)
-			SendSSEErrorEvent(w, "Unexpected error occured while running tests. Please try again later.", flusher)
+		if err := SendSSEJSONEvent(w, "step", &stepReport, flusher); err != nil {
 			return
-		} else {
-			app.logger.Info("stress test completed successfully", "remote_addr", r.RemoteAddr)
-			fmt.Fprintf(w, "event: done\n")
-			fmt.Fprintf(w, "data: {\"outputLine\": \"Tests completed successfully.\"}\n\n")
-			flusher.Flush()
 		}
 	}
+
+	report.FinishedAt = time.Now()
+	if err := SaveStressReport(app.cfg.StressReportDir, report, app.cfg.StressReportRetention); err != nil {
+		app.logger.Error("failed to save stress test report", "report", report.Id, "error", err)
+		SendSSEErrorEvent(w, "Tests completed but the report could not be saved.", flusher)
+		return
+	}
+
+	app.logger.Info("stress test completed", "remote_addr", r.RemoteAddr, "report", report.Id, "passed", report.Passed, "regressions", report.Regressions)
+	SendSSEJSONEvent(w, "done", &StressTestDone{
+		Report:      report.Id,
+		Passed:      report.Passed,
+		Steps:       len(report.Steps),
+		Regressions: report.Regressions,
+		JsonUrl:     "/api/stress-test/reports/" + report.Id + ".json",
+		HtmlUrl:     "/api/stress-test/reports/" + report.Id + ".html",
+	}, flusher)
+}
+
+// StressTestReport serves a report saved by a previous run as JSON or HTML.
+func (app *App) StressTestReport(w http.ResponseWriter, r *http.Request) {
+	file := r.PathValue("report")
+	id, contentType := strings.TrimSuffix(file, ".html"), "text/html; charset=utf-8"
+	if strings.HasSuffix(file, ".json") {
+		id, contentType = strings.TrimSuffix(file, ".json"), "application/json"
+	}
+
+	if id == file || !stressFileName.MatchString(id) {
+		app.writeNotFoundPage(w)
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(app.cfg.StressReportDir, file))
+	if err != nil {
+		app.logger.Info("stress test report not found", "report", file)
+		app.writeNotFoundPage(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
 }
@@ -0,0 +1,102 @@
+// Package expiry provides a min-heap of keys ordered by time, used by the
+// limiters and the shortener to find expired entries without a full scan.
+package expiry
+
+import (
+	"container/heap"
+	"time"
+)
+
+const (
+	// SweepInterval is the longest an expired entry outlives its deadline.
+	SweepInterval = time.Second
+	// BatchSize bounds how many entries a sweep removes per lock acquisition.
+	BatchSize = 512
+)
+
+type timeQueueItem struct {
+	key   string
+	at    time.Time
+	index int
+}
+
+type timeQueueHeap []*timeQueueItem
+
+func (h timeQueueHeap) Len() int           { return len(h) }
+func (h timeQueueHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h timeQueueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timeQueueHeap) Push(x any) {
+	item := x.(*timeQueueItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *timeQueueHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// Queue is a min-heap of keys ordered by time, so stores can find their
+// expired entries without scanning everything. It is not safe for concurrent
+// use, callers guard it with their own lock.
+type Queue struct {
+	heap  timeQueueHeap
+	items map[string]*timeQueueItem
+}
+
+func New() *Queue {
+	return &Queue{items: make(map[string]*timeQueueItem)}
+}
+
+// Set adds key at time at, or moves it there if already queued.
+func (q *Queue) Set(key string, at time.Time) {
+	if item, ok := q.items[key]; ok {
+		item.at = at
+		heap.Fix(&q.heap, item.index)
+		return
+	}
+
+	item := &timeQueueItem{key: key, at: at}
+	q.items[key] = item
+	heap.Push(&q.heap, item)
+}
+
+func (q *Queue) Remove(key string) {
+	if item, ok := q.items[key]; ok {
+		heap.Remove(&q.heap, item.index)
+		delete(q.items, key)
+	}
+}
+
+// PopBefore removes and returns up to max keys queued at or before cutoff,
+// earliest first.
+func (q *Queue) PopBefore(cutoff time.Time, max int) []string {
+	keys := []string{}
+	for len(keys) < max && len(q.heap) > 0 && !q.heap[0].at.After(cutoff) {
+		item := heap.Pop(&q.heap).(*timeQueueItem)
+		delete(q.items, item.key)
+		keys = append(keys, item.key)
+	}
+	return keys
+}
+
+// Peek returns the earliest key and its time without removing it.
+func (q *Queue) Peek() (string, time.Time, bool) {
+	if len(q.heap) == 0 {
+		return "", time.Time{}, false
+	}
+	return q.heap[0].key, q.heap[0].at, true
+}
+
+func (q *Queue) Len() int {
+	return len(q.heap)
+}
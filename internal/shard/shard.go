@@ -0,0 +1,61 @@
+// Package shard holds the helpers shared by the sharded in-memory stores.
+package shard
+
+import (
+	"hash/fnv"
+	"runtime"
+	"sync/atomic"
+)
+
+// Count sizes sharded stores: a power of two comfortably above the number
+// of goroutines that can run at once, so lock collisions stay rare.
+func Count() int {
+	n := 1
+	for n < 4*runtime.GOMAXPROCS(0) {
+		n <<= 1
+	}
+	return n
+}
+
+// Index maps key to one of n shards, n being a power of two.
+func Index(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() & uint32(n-1))
+}
+
+// Slots counts the entries of every shard of a store against one capacity,
+// so a busy shard can use the room the others leave.
+type Slots struct {
+	cap  int64
+	used atomic.Int64
+}
+
+func NewSlots(cap int) *Slots {
+	return &Slots{cap: int64(cap)}
+}
+
+// Acquire takes a slot, or reports false when all of them are used.
+func (s *Slots) Acquire() bool {
+	for {
+		used := s.used.Load()
+		if used >= s.cap {
+			return false
+		}
+		if s.used.CompareAndSwap(used, used+1) {
+			return true
+		}
+	}
+}
+
+func (s *Slots) Release(n int) {
+	s.used.Add(-int64(n))
+}
+
+func (s *Slots) Cap() int {
+	return int(s.cap)
+}
+
+func (s *Slots) Len() int {
+	return int(s.used.Load())
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dessources/go_rate_limiter/internal/shard"
+	"github.com/dessources/go_rate_limiter/ratelimit"
+)
+
+// newGlobalRateLimiter picks the token store matching storageType.
+func newGlobalRateLimiter(storageType StorageType, count int, cap int, rate int) (*ratelimit.GlobalRateLimiter, error) {
+	opts := ratelimit.GlobalOptions{Capacity: cap, InitialTokens: count, RatePerMinute: rate}
+
+	switch storageType {
+	case InMemory:
+		return ratelimit.NewGlobalRateLimiter(opts)
+	case ShardedInMemory:
+		bucket, err := ratelimit.NewAtomicBucket(count, cap)
+		if err != nil {
+			return nil, err
+		}
+		opts.Store = bucket
+		return ratelimit.NewGlobalRateLimiter(opts)
+	case Redis:
+		return nil, errors.New("Redis storage not yet implemented")
+	default:
+		return nil, errors.New("Unknown storage type provided.")
+	}
+}
+
+// newPerClientRateLimiter picks the time log store matching storageType.
+func newPerClientRateLimiter(storageType StorageType, cap int, limit int, window, ttl time.Duration) (*ratelimit.PerClientRateLimiter, error) {
+	opts := ratelimit.PerClientOptions{Limit: limit, Window: window, ClientTTL: ttl, Capacity: cap}
+
+	switch storageType {
+	case InMemory:
+		return ratelimit.NewPerClientRateLimiter(opts)
+	case ShardedInMemory:
+		opts.Store = ratelimit.NewShardedTimeLogStore(shard.Count(), cap, limit)
+		return ratelimit.NewPerClientRateLimiter(opts)
+	case Redis:
+		return nil, errors.New("Redis storage not yet implemented")
+	default:
+		return nil, errors.New("Unknown storage type provided.")
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxLoadConcurrency = 200
+	maxLoadRequests    = 200000
+	maxLoadDuration    = time.Minute
+	maxLoadRate        = 100000
+	loadRequestTimeout = 5 * time.Second
+	// loadLatencySampleSize bounds the reservoir used for the summary percentiles.
+	loadLatencySampleSize = 100000
+)
+
+// Duration is a time.Duration that reads and writes JSON as a string such as "10s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("Durations must be strings such as \"10s\".")
+	}
+	value, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(value)
+	return nil
+}
+
+// LoadScenario describes one run of the load generator against a single route.
+// It stops after Requests requests or once Duration has passed, whichever
+// comes first; at least one of them must be set.
+type LoadScenario struct {
+	Name        string            `json:"name"`
+	Method      string            `json:"method"`
+	Path        string            `json:"path"`
+	Body        string            `json:"body,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ApiKeys     []string          `json:"apiKeys,omitempty"` // sent round robin as X-API-Key
+	Concurrency int               `json:"concurrency"`
+	Requests    int               `json:"requests,omitempty"`
+	Duration    Duration          `json:"duration,omitempty"`
+	Rate        int               `json:"rate,omitempty"`  // requests per second across all workers, 0 is unthrottled
+	Pause       Duration          `json:"pause,omitempty"` // wait before starting, e.g. to let limiters refill
+}
+
+func (s *LoadScenario) Validate() error {
+	if s.Method == "" {
+		s.Method = http.MethodGet
+	}
+	if s.Concurrency == 0 {
+		s.Concurrency = 1
+	}
+
+	switch {
+	case !strings.HasPrefix(s.Path, "/"):
+		return errors.New("Path must start with '/'.")
+	case s.Concurrency < 1 || s.Concurrency > maxLoadConcurrency:
+		return fmt.Errorf("Concurrency must be between 1 and %d.", maxLoadConcurrency)
+	case s.Requests < 0 || s.Requests > maxLoadRequests:
+		return fmt.Errorf("Requests must be between 0 and %d.", maxLoadRequests)
+	case s.Duration < 0 || time.Duration(s.Duration) > maxLoadDuration:
+		return fmt.Errorf("Duration must be at most %s.", maxLoadDuration)
+	case s.Requests == 0 && s.Duration == 0:
+		return errors.New("Either requests or duration must be set.")
+	case s.Rate < 0 || s.Rate > maxLoadRate:
+		return fmt.Errorf("Rate must be between 0 and %d requests per second.", maxLoadRate)
+	case s.Pause < 0 || time.Duration(s.Pause) > maxLoadDuration:
+		return fmt.Errorf("Pause must be at most %s.", maxLoadDuration)
+	}
+	return nil
+}
+
+// ParseLoadScenario reads a single scenario from query parameters, e.g.
+// ?path=/api/shorten&method=POST&concurrency=10&duration=5s&rate=200&apiKeys=a,b
+func ParseLoadScenario(query url.Values) (LoadScenario, error) {
+	scenario := LoadScenario{
+		Name:   query.Get("name"),
+		Method: strings.ToUpper(query.Get("method")),
+		Path:   query.Get("path"),
+		Body:   query.Get("body"),
+	}
+	if scenario.Name == "" {
+		scenario.Name = "Custom scenario"
+	}
+	if keys := query.Get("apiKeys"); keys != "" {
+		scenario.ApiKeys = strings.Split(keys, ",")
+	}
+	if scenario.Body != "" {
+		scenario.Headers = map[string]string{"Content-Type": "application/json"}
+	}
+
+	var err error
+	parseInt := func(name string) int {
+		value := query.Get(name)
+		if value == "" || err != nil {
+			return 0
+		}
+		n, parseErr := strconv.Atoi(value)
+		if parseErr != nil {
+			err = fmt.Errorf("Query parameter %s must be an integer.", name)
+		}
+		return n
+	}
+	parseDuration := func(name string) Duration {
+		value := query.Get(name)
+		if value == "" || err != nil {
+			return 0
+		}
+		d, parseErr := time.ParseDuration(value)
+		if parseErr != nil {
+			err = fmt.Errorf("Query parameter %s must be a duration such as 10s.", name)
+		}
+		return Duration(d)
+	}
+
+	scenario.Concurrency = parseInt("concurrency")
+	scenario.Requests = parseInt("requests")
+	scenario.Rate = parseInt("rate")
+	scenario.Duration = parseDuration("duration")
+	if err != nil {
+		return scenario, err
+	}
+	return scenario, scenario.Validate()
+}
+
+type LoadProgress struct {
+	Scenario       string      `json:"scenario"`
+	Second         int         `json:"second"`
+	Completed      int         `json:"completed"` // since the scenario started
+	RequestsPerSec int         `json:"requestsPerSec"`
+	StatusCounts   map[int]int `json:"statusCounts"` // during the last second
+	Errors         int         `json:"errors"`       // during the last second
+}
+
+type LatencySummary struct {
+	P50Ms float64 `json:"p50Ms"`
+	P90Ms float64 `json:"p90Ms"`
+	P99Ms float64 `json:"p99Ms"`
+	MaxMs float64 `json:"maxMs"`
+}
+
+type LoadSummary struct {
+	Scenario       string         `json:"scenario"`
+	Requests       int            `json:"requests"`
+	Errors         int            `json:"errors"` // requests that got no response
+	DurationMs     int64          `json:"durationMs"`
+	RequestsPerSec float64        `json:"requestsPerSec"`
+	StatusCounts   map[int]int    `json:"statusCounts"`
+	Latency        LatencySummary `json:"latency"`
+	Cancelled      bool           `json:"cancelled,omitempty"`
+}
+
+type loadResult struct {
+	status  int // 0 when the request failed
+	latency time.Duration
+}
+
+// loadStats aggregates results as they come in.
+type loadStats struct {
+	mu           sync.Mutex
+	total        int
+	errors       int
+	statusCounts map[int]int
+	window       map[int]int // status counts since the last progress report
+	windowCount  int
+	windowErrors int
+	latencies    []time.Duration
+	maxLatency   time.Duration
+}
+
+func (s *loadStats) add(result loadResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.total++
+	s.windowCount++
+	if result.status == 0 {
+		s.errors++
+		s.windowErrors++
+		return
+	}
+	s.statusCounts[result.status]++
+	s.window[result.status]++
+
+	s.maxLatency = max(s.maxLatency, result.latency)
+	if len(s.latencies) < loadLatencySampleSize {
+		s.latencies = append(s.latencies, result.latency)
+	} else if i := rand.IntN(s.total); i < loadLatencySampleSize {
+		s.latencies[i] = result.latency
+	}
+}
+
+func (s *loadStats) progress(scenario string, second int) LoadProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	progress := LoadProgress{scenario, second, s.total, s.windowCount, s.window, s.windowErrors}
+	s.window = make(map[int]int)
+	s.windowCount = 0
+	s.windowErrors = 0
+	return progress
+}
+
+// RunLoad sends the scenario's requests to baseUrl, calling progress once per
+// second from the calling goroutine. It returns early, with Cancelled set, when
+// ctx ends.
+func RunLoad(ctx context.Context, client *http.Client, baseUrl string, scenario LoadScenario, progress func(LoadProgress)) (LoadSummary, error) {
+	if err := scenario.Validate(); err != nil {
+		return LoadSummary{}, err
+	}
+
+	if scenario.Pause > 0 {
+		select {
+		case <-time.After(time.Duration(scenario.Pause)):
+		case <-ctx.Done():
+			return LoadSummary{Scenario: scenario.Name, StatusCounts: map[int]int{}, Cancelled: true}, nil
+		}
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	if scenario.Duration > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, time.Duration(scenario.Duration))
+	}
+	defer cancel()
+
+	// with a rate, workers take a token per request from a paced channel
+	var tokens <-chan time.Time
+	if scenario.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(scenario.Rate))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+
+	stats := &loadStats{statusCounts: make(map[int]int), window: make(map[int]int)}
+	var issued atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for range scenario.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := issued.Add(1)
+				if scenario.Requests > 0 && n > int64(scenario.Requests) {
+					return
+				}
+				if tokens != nil {
+					select {
+					case <-tokens:
+					case <-runCtx.Done():
+						return
+					}
+				}
+				if runCtx.Err() != nil {
+					return
+				}
+				result := sendLoadRequest(runCtx, client, baseUrl, scenario, n)
+				if result.status == 0 && runCtx.Err() != nil {
+					// cut short by the deadline or a cancellation, not a failure
+					return
+				}
+				stats.add(result)
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	second := 0
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			second++
+			progress(stats.progress(scenario.Name, second))
+		case <-finished:
+			running = false
+		}
+	}
+
+	elapsed := time.Since(start)
+	summary := LoadSummary{
+		Scenario:       scenario.Name,
+		Requests:       stats.total,
+		Errors:         stats.errors,
+		DurationMs:     elapsed.Milliseconds(),
+		RequestsPerSec: float64(stats.total) / max(elapsed.Seconds(), 1e-3),
+		StatusCounts:   stats.statusCounts,
+		Cancelled:      ctx.Err() != nil,
+	}
+	if len(stats.latencies) > 0 {
+		slices.Sort(stats.latencies)
+		summary.Latency = LatencySummary{
+			P50Ms: percentile(stats.latencies, 0.50),
+			P90Ms: percentile(stats.latencies, 0.90),
+			P99Ms: percentile(stats.latencies, 0.99),
+			MaxMs: float64(stats.maxLatency.Microseconds()) / 1000,
+		}
+	}
+	return summary, nil
+}
+
+func sendLoadRequest(ctx context.Context, client *http.Client, baseUrl string, scenario LoadScenario, n int64) loadResult {
+	var body io.Reader
+	if scenario.Body != "" {
+		body = strings.NewReader(scenario.Body)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, scenario.Method, baseUrl+scenario.Path, body)
+	if err != nil {
+		return loadResult{}
+	}
+	for key, value := range scenario.Headers {
+		request.Header.Set(key, value)
+	}
+	if len(scenario.ApiKeys) > 0 {
+		request.Header.Set("X-API-Key", scenario.ApiKeys[int(n)%len(scenario.ApiKeys)])
+	}
+
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		return loadResult{}
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	return loadResult{response.StatusCode, time.Since(start)}
+}
+
+// NewLoadClient returns a client that keeps enough idle connections for
+// concurrency workers and reports redirects instead of following them.
+func NewLoadClient(concurrency int) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = concurrency
+	return &http.Client{
+		Transport: transport,
+		Timeout:   loadRequestTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+
+	"github.com/dessources/go_rate_limiter/ratelimit"
 )
 
 type Middleware func(http.Handler) http.Handler
@@ -12,9 +15,22 @@ type StorageType int
 
 const (
 	InMemory StorageType = iota
+	ShardedInMemory
 	Redis
 )
 
+func ParseStorageType(s string) (StorageType, error) {
+	switch s {
+	case "", "memory":
+		return InMemory, nil
+	case "sharded":
+		return ShardedInMemory, nil
+	case "redis":
+		return Redis, nil
+	}
+	return InMemory, fmt.Errorf("unknown storage type %q, expected memory, sharded or redis", s)
+}
+
 func main() {
 
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
@@ -24,15 +40,23 @@ func main() {
 		logger.Error("failed to load configuration", "error", err)
 		return
 	}
+
+	if cfg.Mode == "proxy" {
+		if err := RunProxy(logger, cfg); err != nil {
+			logger.Error("proxy failed", "error", err)
+		}
+		return
+	}
+
 	server := &http.Server{
 		Addr: cfg.ServerAddr,
 	}
 
-	idleConnsClosed := make(chan struct{})
-	EnableGracefulShutdown(logger, idleConnsClosed, server)
+	//counts limiter decisions, shortens, redirects and latencies for the metrics stream
+	metrics := NewMetricsRecorder()
 
 	//create global limiter & middleware
-	rateLimitGlobally, globalRateLimiter, err := MakeGlobalRateLimitMiddleware(logger, InMemory, cfg.GlobalLimiterCount, cfg.GlobalLimiterCap, cfg.GlobalLimiterRate)
+	rateLimitGlobally, globalRateLimiter, err := MakeGlobalRateLimitMiddleware(logger, metrics, cfg.StorageType, cfg.GlobalLimiterCount, cfg.GlobalLimiterCap, cfg.GlobalLimiterRate, cfg.GlobalLimiterShadow)
 	if err != nil {
 		logger.Error("failed to create global rate limiter middleware", "error", err)
 		return
@@ -40,7 +64,7 @@ func main() {
 	defer globalRateLimiter.Offline()
 
 	//create per client limiter & middleware
-	rateLimitPerClient, perClientRateLimiter, err := MakePerClientRateLimitMiddleware(logger, InMemory, cfg.PerClientLimiterCap, cfg.PerClientLimiterLimit, cfg.PerClientLimiterWindow, cfg.PerClientLimiterClientTtl)
+	rateLimitPerClient, perClientRateLimiter, err := MakePerClientRateLimitMiddleware(logger, metrics, cfg.StorageType, cfg.PerClientLimiterCap, cfg.PerClientLimiterLimit, cfg.PerClientLimiterWindow, cfg.PerClientLimiterClientTtl, cfg.ClientMask, cfg.PerClientLimiterShadow)
 
 	if err != nil {
 		logger.Error("failed to create per-client rate limiter middleware", "error", err)
@@ -48,10 +72,86 @@ func main() {
 	}
 	defer perClientRateLimiter.Offline()
 
+	//shows who a tighter per-client limit would block, without blocking them
+	var shadowPerClientRateLimiter *ratelimit.PerClientRateLimiter
+	if cfg.ShadowPerClientLimiterLimit > 0 {
+		var shadowPerClient Middleware
+		shadowPerClient, shadowPerClientRateLimiter, err = MakePerClientRateLimitMiddleware(logger, metrics, cfg.StorageType, cfg.PerClientLimiterCap, cfg.ShadowPerClientLimiterLimit, cfg.PerClientLimiterWindow, cfg.PerClientLimiterClientTtl, cfg.ClientMask, true)
+		if err != nil {
+			logger.Error("failed to create shadow per-client rate limiter middleware", "error", err)
+			return
+		}
+		defer shadowPerClientRateLimiter.Offline()
+		//the shadow limiter goes first so it sees the requests the enforced one refuses
+		rateLimitPerClient = ComposeMiddlewares(shadowPerClient, rateLimitPerClient)
+	}
+
+	//allowlisted clients skip the limiters, denylisted ones are refused
+	accessLists, err := NewAccessLists(cfg.AccessLists, cfg.ClientMask)
+	if err != nil {
+		logger.Error("failed to load access lists", "error", err)
+		return
+	}
+
+	//password attempts on protected links are limited per short code
+	passwordAttemptLimiter, err := newPerClientRateLimiter(InMemory, cfg.ShortenerCap, cfg.PasswordAttemptLimit, cfg.PasswordAttemptWindow, cfg.PasswordAttemptWindow)
+	if err != nil {
+		logger.Error("failed to create password attempt limiter", "error", err)
+		return
+	}
+	defer passwordAttemptLimiter.Offline()
+
+	//limits other services check and consume over http
+	namedLimiters, err := LoadNamedLimits(cfg.NamedLimitsPath, cfg.StorageType, cfg.PerClientLimiterCap)
+	if err != nil {
+		logger.Error("failed to load named limits", "path", cfg.NamedLimitsPath, "error", err)
+		return
+	}
+	defer OfflineNamedLimits(namedLimiters)
+
+	//carry limiter state over from the previous run
+	snapshotLimiters := map[string]*ratelimit.PerClientRateLimiter{"perClient": perClientRateLimiter, "passwordAttempts": passwordAttemptLimiter}
+	for name, limiter := range namedLimiters {
+		snapshotLimiters["named:"+name] = limiter
+	}
+	if cfg.LimiterSnapshotPath != "" {
+		restored, err := ratelimit.RestoreSnapshot(cfg.LimiterSnapshotPath, globalRateLimiter, snapshotLimiters)
+		if err != nil {
+			logger.Warn("ignoring limiter snapshot", "path", cfg.LimiterSnapshotPath, "error", err)
+		} else if restored {
+			logger.Info("limiter snapshot restored", "path", cfg.LimiterSnapshotPath)
+		}
+	}
+
+	//Envoy gateways ask this service whether to let requests through
+	stopRateLimitService := func() {}
+	if cfg.RlsAddr != "" {
+		stopRateLimitService, err = StartRateLimitService(logger, cfg)
+		if err != nil {
+			logger.Error("failed to start rate limit service", "error", err)
+			return
+		}
+	}
+
+	idleConnsClosed := make(chan struct{})
+	EnableGracefulShutdown(logger, idleConnsClosed, server, func() {
+		stopRateLimitService()
+		if cfg.LimiterSnapshotPath == "" {
+			return
+		}
+		if err := ratelimit.SaveSnapshot(cfg.LimiterSnapshotPath, globalRateLimiter, snapshotLimiters); err != nil {
+			logger.Error("failed to save limiter snapshot", "path", cfg.LimiterSnapshotPath, "error", err)
+			return
+		}
+		logger.Info("limiter snapshot saved", "path", cfg.LimiterSnapshotPath)
+	})
+
 	//middleware composers
 	withMiddlewares := ComposeMiddlewares(rateLimitGlobally, rateLimitPerClient)
+	adminOnly := ComposeMiddlewares(rateLimitGlobally, MakeAdminMiddleware(logger, cfg.AdminApiKey))
+	rateLimitServiceOnly := ComposeMiddlewares(rateLimitGlobally, MakeAdminMiddleware(logger, cfg.RateLimitApiKey))
 	//composed middleware for stress test route
-	stressTestMiddlewares, cleanup, err := MakeStressTestRouteMiddlewares(logger)
+	stressTestMiddlewares, cleanup, err := MakeStressTestRouteMiddlewares(logger, cfg.ClientMask)
 	if err != nil {
 		logger.Error("failed to create stress test route middlewares", "error", err)
 		return
@@ -64,7 +164,7 @@ func main() {
 	}
 
 	//url shortener struct
-	shortener, err := NewUrlShortener(InMemory, cfg.ShortenerCap, cfg.ShortenerTTL, cfg.ShortCodeLength)
+	shortener, err := NewUrlShortener(cfg.StorageType, cfg.ShortenerCap, cfg.ShortenerTTL, cfg.ShortCodeLength, cfg.ShortenerDedupe, cfg.ShortenerEviction)
 	if err != nil {
 		logger.Error("failed to create URL shortener", "error", err)
 		return
@@ -72,16 +172,32 @@ func main() {
 	defer shortener.Offline()
 
 	//create app struct with methods for api handler logic
-	app := &App{cfg, logger, page404HTML, shortener, globalRateLimiter, perClientRateLimiter}
+	app := &App{cfg, logger, page404HTML, shortener, globalRateLimiter, perClientRateLimiter, shadowPerClientRateLimiter, passwordAttemptLimiter, metrics, nil, NewRunQueue(cfg.StressTestConcurrency, cfg.StressTestMaxQueue), namedLimiters, accessLists}
+
+	//metrics are computed once per tick and shared by every dashboard
+	app.metricsHub = NewMetricsHub(logger, app.collectMetrics, cfg.MetricsMaxSubscribers, cfg.MetricsHistorySize)
+	defer app.metricsHub.Offline()
 
 	//Route handlers
 	mux := http.NewServeMux()
 	mux.Handle("/", rateLimitGlobally(MakeIndexHandler()))
 	mux.Handle("GET /{shortUrl}", rateLimitGlobally(http.HandlerFunc(app.RetrieveUrl)))
+	mux.Handle("POST /{shortUrl}", rateLimitGlobally(http.HandlerFunc(app.UnlockUrl)))
+	mux.Handle("GET /api/qr/{shortUrl}", rateLimitGlobally(http.HandlerFunc(app.QRCode)))
 	mux.Handle("POST /api/shorten", withMiddlewares(http.HandlerFunc(app.ShortenUrl)))
+	// batch is debited per item against the per-client limiter by its handler
+	mux.Handle("POST /api/shorten/batch", rateLimitGlobally(http.HandlerFunc(app.ShortenBatch)))
+	mux.Handle("GET /api/admin/export", adminOnly(http.HandlerFunc(app.ExportMappings)))
+	mux.Handle("POST /api/admin/import", adminOnly(http.HandlerFunc(app.ImportMappings)))
+	mux.Handle("GET /api/admin/access-lists", adminOnly(http.HandlerFunc(app.GetAccessLists)))
+	mux.Handle("PUT /api/admin/access-lists", adminOnly(http.HandlerFunc(app.SetAccessLists)))
+	mux.Handle("POST /api/ratelimit/check", rateLimitServiceOnly(http.HandlerFunc(app.CheckRateLimit)))
+	mux.Handle("POST /api/ratelimit/consume", rateLimitServiceOnly(http.HandlerFunc(app.ConsumeRateLimit)))
 	mux.Handle("GET /api/metrics/stream", rateLimitGlobally(http.HandlerFunc(app.StreamMetrics)))
-	mux.Handle("GET /api/stress-test/stream", stressTestMiddlewares(http.HandlerFunc(app.StressTest)))
-	server.Handler = SetupCors(mux, cfg)
+	mux.Handle("GET /api/stress-test/stream", stressTestMiddlewares(MakeCustomScenarioMiddleware(logger, cfg.AdminApiKey)(http.HandlerFunc(app.StressTest))))
+	mux.Handle("GET /api/stress-test/reports/{report}", rateLimitGlobally(http.HandlerFunc(app.StressTestReport)))
+	//allow and deny lists are checked before any limiter, inside CORS so browsers can read a 403
+	server.Handler = MakeLatencyMiddleware(metrics)(SetupCors(MakeAccessListMiddleware(logger, accessLists)(mux), cfg))
 
 	logger.Info("server starting", "addr", cfg.ServerAddr)
 	if err := server.ListenAndServe(); err != http.ErrServerClosed {
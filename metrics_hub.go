@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// metricsSubscriberBuffer is how many ticks a subscriber may fall behind
+	// before it is dropped.
+	metricsSubscriberBuffer = 4
+	// metricsEvent is the SSE event type of each metrics point.
+	metricsEvent = "metrics"
+	// metricsRetryMillis tells EventSource how long to wait before reconnecting.
+	metricsRetryMillis = 3000
+)
+
+var ErrTooManySubscribers = errors.New("Too many clients are streaming metrics. Please try again later.")
+
+// metricsFrame is one encoded SSE event, ready to be written to any subscriber.
+type metricsFrame struct {
+	id   uint64
+	data []byte
+}
+
+// MetricsHub computes Metrics once per tick and broadcasts the encoded event to
+// every subscriber, so the cost of reading the stores doesn't grow with the
+// number of open dashboards. The latest points are kept in a ring buffer so a
+// reconnecting subscriber can catch up on what it missed.
+type MetricsHub struct {
+	logger         *slog.Logger
+	collect        func() Metrics
+	maxSubscribers int
+	subscribers    map[chan []byte]struct{}
+	history        []metricsFrame // ring buffer, oldest at historyStart
+	historyStart   int
+	lastId         uint64
+	mu             sync.Mutex
+	done           chan struct{}
+}
+
+func NewMetricsHub(logger *slog.Logger, collect func() Metrics, maxSubscribers, historySize int) *MetricsHub {
+	hub := &MetricsHub{
+		logger:         logger,
+		collect:        collect,
+		maxSubscribers: maxSubscribers,
+		subscribers:    make(map[chan []byte]struct{}),
+		history:        make([]metricsFrame, 0, historySize),
+		done:           make(chan struct{}),
+	}
+	go hub.run()
+	return hub
+}
+
+// Subscribe registers a new subscriber and returns the buffered events newer
+// than lastEventId, which is 0 for a fresh subscriber. The returned channel is
+// closed if the subscriber falls behind or the hub goes offline; unsubscribe
+// must be called once the subscriber is done either way.
+func (h *MetricsHub) Subscribe(lastEventId uint64) ([][]byte, <-chan []byte, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.subscribers) >= h.maxSubscribers {
+		return nil, nil, nil, ErrTooManySubscribers
+	}
+
+	// replayed under the same lock as the broadcast, so no point is missed or
+	// sent twice. An id ahead of ours predates a restart, so all history is new to it.
+	missed := [][]byte{}
+	if lastEventId > 0 {
+		for i := range h.history {
+			frame := h.history[(h.historyStart+i)%len(h.history)]
+			if frame.id > lastEventId || lastEventId > h.lastId {
+				missed = append(missed, frame.data)
+			}
+		}
+	}
+
+	ch := make(chan []byte, metricsSubscriberBuffer)
+	h.subscribers[ch] = struct{}{}
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[ch]; ok {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+	return missed, ch, unsubscribe, nil
+}
+
+func (h *MetricsHub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+// run collects on every tick, even without subscribers, so the history and
+// the per second rates have no gaps.
+func (h *MetricsHub) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			data, err := json.Marshal(h.collect())
+			if err != nil {
+				h.logger.Error("failed to marshal metrics data", "error", err)
+				continue
+			}
+			h.broadcast(data)
+
+		case <-h.done:
+			h.mu.Lock()
+			for ch := range h.subscribers {
+				delete(h.subscribers, ch)
+				close(ch)
+			}
+			h.mu.Unlock()
+			return
+		}
+	}
+}
+
+// broadcast records the point in the history and sends it to every
+// subscriber. It never blocks, a subscriber whose buffer is full is dropped.
+func (h *MetricsHub) broadcast(data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastId++
+	frame := metricsFrame{h.lastId, []byte(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", h.lastId, metricsEvent, data))}
+	if len(h.history) < cap(h.history) {
+		h.history = append(h.history, frame)
+	} else if len(h.history) > 0 {
+		h.history[h.historyStart] = frame
+		h.historyStart = (h.historyStart + 1) % len(h.history)
+	}
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- frame.data:
+		default:
+			delete(h.subscribers, ch)
+			close(ch)
+			h.logger.Warn("dropped slow metrics subscriber", "buffered", metricsSubscriberBuffer)
+		}
+	}
+}
+
+func (h *MetricsHub) Offline() {
+	close(h.done)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// topRejectedClients is how many client ids each metrics point lists.
+	topRejectedClients = 5
+	// maxTrackedRejectedClients bounds the rejection counts kept between two ticks.
+	maxTrackedRejectedClients = 10000
+	// latencySampleSize bounds the reservoir used for latency percentiles.
+	latencySampleSize = 2048
+)
+
+type ClientRejections struct {
+	ClientId string `json:"clientId"` // network and API key digest, see redactClientId
+	Count    int    `json:"count"`
+}
+
+// MetricsRecorder counts events between two metrics ticks. All methods are
+// safe for concurrent use and no-ops on a nil recorder, so limiters and
+// handlers that aren't wired to a dashboard can share the same code paths.
+type MetricsRecorder struct {
+	globalAllowed     atomic.Int64
+	globalRejected    atomic.Int64
+	perClientAllowed  atomic.Int64
+	perClientRejected atomic.Int64
+	shortens          atomic.Int64
+	redirects         atomic.Int64
+
+	// requests shadow limiters would have refused
+	globalShadowRejected    atomic.Int64
+	perClientShadowRejected atomic.Int64
+
+	mu               sync.Mutex
+	rejections       map[string]int
+	shadowRejections map[string]int
+	latencies        []time.Duration // reservoir sample of this tick's request latencies
+	requests         int
+	since            time.Time
+}
+
+func NewMetricsRecorder() *MetricsRecorder {
+	return &MetricsRecorder{rejections: make(map[string]int), shadowRejections: make(map[string]int), since: time.Now()}
+}
+
+func (m *MetricsRecorder) GlobalLimit(allowed bool) {
+	if m == nil {
+		return
+	}
+	if allowed {
+		m.globalAllowed.Add(1)
+	} else {
+		m.globalRejected.Add(1)
+	}
+}
+
+func (m *MetricsRecorder) PerClientLimit(clientId string, allowed bool) {
+	if m == nil {
+		return
+	}
+	if allowed {
+		m.perClientAllowed.Add(1)
+		return
+	}
+	m.perClientRejected.Add(1)
+	clientId = redactClientId(clientId)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rejections[clientId]; ok || len(m.rejections) < maxTrackedRejectedClients {
+		m.rejections[clientId]++
+	}
+}
+
+func (m *MetricsRecorder) GlobalShadowRejected() {
+	if m != nil {
+		m.globalShadowRejected.Add(1)
+	}
+}
+
+func (m *MetricsRecorder) PerClientShadowRejected(clientId string) {
+	if m == nil {
+		return
+	}
+	m.perClientShadowRejected.Add(1)
+	clientId = redactClientId(clientId)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.shadowRejections[clientId]; ok || len(m.shadowRejections) < maxTrackedRejectedClients {
+		m.shadowRejections[clientId]++
+	}
+}
+
+func (m *MetricsRecorder) Shortened(count int) {
+	if m != nil {
+		m.shortens.Add(int64(count))
+	}
+}
+
+func (m *MetricsRecorder) Redirected() {
+	if m != nil {
+		m.redirects.Add(1)
+	}
+}
+
+func (m *MetricsRecorder) Latency(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests++
+	if len(m.latencies) < latencySampleSize {
+		m.latencies = append(m.latencies, d)
+	} else if i := rand.IntN(m.requests); i < latencySampleSize {
+		m.latencies[i] = d
+	}
+}
+
+// Collect fills the rate, top client and latency fields of metrics with what
+// was recorded since the previous call, and resets the counters.
+func (m *MetricsRecorder) Collect(metrics *Metrics) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	rejections, shadowRejections, latencies, since := m.rejections, m.shadowRejections, m.latencies, m.since
+	m.rejections = make(map[string]int)
+	m.shadowRejections = make(map[string]int)
+	m.latencies = make([]time.Duration, 0, len(latencies))
+	m.requests = 0
+	m.since = time.Now()
+	m.mu.Unlock()
+
+	elapsed := max(time.Since(since).Seconds(), 1e-3)
+	perSecond := func(counter *atomic.Int64) float64 {
+		return float64(counter.Swap(0)) / elapsed
+	}
+
+	metrics.GlobalAllowedPerSec = perSecond(&m.globalAllowed)
+	metrics.GlobalRejectedPerSec = perSecond(&m.globalRejected)
+	metrics.PerClientAllowedPerSec = perSecond(&m.perClientAllowed)
+	metrics.PerClientRejectedPerSec = perSecond(&m.perClientRejected)
+	metrics.ShadowGlobalRejectedPerSec = perSecond(&m.globalShadowRejected)
+	metrics.ShadowPerClientRejectedPerSec = perSecond(&m.perClientShadowRejected)
+	metrics.ShortensPerSec = perSecond(&m.shortens)
+	metrics.RedirectsPerSec = perSecond(&m.redirects)
+
+	metrics.TopRejectedClients = topClients(rejections)
+	metrics.TopShadowRejectedClients = topClients(shadowRejections)
+
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		metrics.LatencyP50Ms = percentile(latencies, 0.50)
+		metrics.LatencyP99Ms = percentile(latencies, 0.99)
+	}
+}
+
+// redactClientId keeps the network of a "network:apiKey" client id and
+// replaces the key with the start of its SHA-256, since the metrics stream
+// is public. The network is the shortest prefix that parses, IPv6 networks
+// contain colons too.
+func redactClientId(clientId string) string {
+	for i, c := range clientId {
+		if c != ':' {
+			continue
+		}
+		network := clientId[:i]
+		if _, err := netip.ParseAddr(network); err != nil {
+			if _, err := netip.ParsePrefix(network); err != nil {
+				continue
+			}
+		}
+		return network + ":" + keyDigest(clientId[i+1:])
+	}
+	return keyDigest(clientId)
+}
+
+func keyDigest(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:6])
+}
+
+// topClients lists the topRejectedClients clients with the most rejections.
+func topClients(rejections map[string]int) []ClientRejections {
+	top := make([]ClientRejections, 0, len(rejections))
+	for clientId, count := range rejections {
+		top = append(top, ClientRejections{clientId, count})
+	}
+	slices.SortFunc(top, func(a, b ClientRejections) int {
+		return b.Count - a.Count
+	})
+	return top[:min(len(top), topRejectedClients)]
+}
+
+// percentile expects sorted latencies and returns milliseconds.
+func percentile(sorted []time.Duration, p float64) float64 {
+	i := min(int(p*float64(len(sorted))), len(sorted)-1)
+	return float64(sorted[i].Microseconds()) / 1000
+}
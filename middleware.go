@@ -1,86 +1,190 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
+
+	"github.com/dessources/go_rate_limiter/ratelimit"
 )
 
 var routesLimitedPerClient []string = []string{"/api/shorten", "/api/stress-test/stream"}
 
-func MakeGlobalRateLimitMiddleware(logger *slog.Logger, storageType StorageType, count int, cap int, rate int) (Middleware, *GlobalRateLimiter, error) {
-	limiter, err := NewGlobalRateLimiter(storageType, count, cap, rate)
+// MakeGlobalRateLimitMiddleware limits every request with a token bucket. In
+// shadow mode requests are never refused, would-be rejections are only logged
+// and counted apart, every request counts as allowed.
+func MakeGlobalRateLimitMiddleware(logger *slog.Logger, recorder *MetricsRecorder, storageType StorageType, count int, cap int, rate int, shadow bool) (Middleware, *ratelimit.GlobalRateLimiter, error) {
+	limiter, err := newGlobalRateLimiter(storageType, count, cap, rate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := ratelimit.GlobalMiddlewareOptions{
+		Skip: isExemptFromLimits,
+		OnReject: func(w http.ResponseWriter, r *http.Request, rejection ratelimit.Rejection) {
+			logger.Warn("global rate limit exceeded", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+			ratelimit.DefaultRejectHandler(w, r, rejection)
+		},
+		OnDecision: func(r *http.Request, allowed bool) {
+			recorder.GlobalLimit(allowed || shadow)
+		},
+	}
+	if shadow {
+		opts.Shadow = true
+		opts.OnShadowReject = func(r *http.Request, rejection ratelimit.Rejection) {
+			logger.Info("shadow global rate limit exceeded", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+			recorder.GlobalShadowRejected()
+		}
+	}
+	return ratelimit.GlobalMiddleware(limiter, opts), limiter, nil
+}
+
+// ClientMask is how much of a client's IP identifies it, so clients rotating
+// through the addresses of a network are still counted as one. The zero
+// ClientMask keeps addresses whole.
+type ClientMask struct {
+	IPv4Bits int
+	IPv6Bits int
+}
+
+// Mask returns the network ip belongs to, e.g. "2001:db8:1:2::/64".
+func (m ClientMask) Mask(ip string) string {
+	if m == (ClientMask{}) {
+		return ip
+	}
+	return ratelimit.MaskIP(ip, m.IPv4Bits, m.IPv6Bits)
+}
+
+// ClientIP keys requests by the network of their IP.
+func (m ClientMask) ClientIP() ratelimit.KeyFunc {
+	if m == (ClientMask{}) {
+		return ratelimit.ClientIP
+	}
+	return ratelimit.ClientPrefix(m.IPv4Bits, m.IPv6Bits)
+}
+
+// ClientId identifies a client by the combination of its IP network and API
+// key. It reports false when the request carries no API key.
+func (m ClientMask) ClientId(r *http.Request) (string, bool) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return "", false
+	}
+
+	return fmt.Sprintf("%s:%s", m.Mask(ip), apiKey), true
+}
+
+// MakePerClientRateLimitMiddleware limits the routes in routesLimitedPerClient
+// with a sliding window per client. A shadow limiter never refuses requests,
+// it logs and counts the clients it would have refused, so it can run next to
+// the enforced one to try out a tighter limit.
+func MakePerClientRateLimitMiddleware(logger *slog.Logger, recorder *MetricsRecorder, storageType StorageType, cap int, limit int, window, ttl time.Duration, mask ClientMask, shadow bool) (Middleware, *ratelimit.PerClientRateLimiter, error) {
+	limiter, err := newPerClientRateLimiter(storageType, cap, limit, window, ttl)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	//Clients identifed by combination of IP and API key
+	opts := ratelimit.PerClientMiddlewareOptions{
+		Key: mask.ClientId,
+		Skip: func(r *http.Request) bool {
+			return isExemptFromLimits(r) || !slices.Contains(routesLimitedPerClient, r.URL.Path)
+		},
+		OnReject: func(w http.ResponseWriter, r *http.Request, rejection ratelimit.Rejection) {
+			switch rejection.Reason {
+			case ratelimit.ReasonMissingKey:
+				logger.Warn("invalid API key provided", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+			case ratelimit.ReasonStoreFull:
+				logger.Warn("per-client rate limiter storage full", "client_id", rejection.Key, "path", r.URL.Path)
+			default:
+				logger.Warn("per-client rate limit exceeded", "client_id", rejection.Key, "path", r.URL.Path)
+			}
+			ratelimit.DefaultRejectHandler(w, r, rejection)
+		},
+		OnDecision: func(r *http.Request, key string, allowed bool) {
+			recorder.PerClientLimit(key, allowed)
+		},
+	}
+	if shadow {
+		opts.OnReject, opts.OnDecision = nil, nil
+		opts.Shadow = true
+		opts.OnShadowReject = func(r *http.Request, rejection ratelimit.Rejection) {
+			// requests without a key can't be attributed to a client
+			if rejection.Reason == ratelimit.ReasonMissingKey {
+				return
+			}
+			logger.Info("shadow per-client rate limit exceeded", "client_id", rejection.Key, "reason", rejection.Reason, "limit", limit, "path", r.URL.Path)
+			recorder.PerClientShadowRejected(rejection.Key)
+		}
+	}
+	return ratelimit.PerClientMiddleware(limiter, opts), limiter, nil
+}
+
+// MakeLatencyMiddleware records how long each request takes to be served.
+// Event streams stay open for as long as the client listens, so they are left out.
+func MakeLatencyMiddleware(recorder *MetricsRecorder) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if limiter.Allow(1) {
+			if strings.HasSuffix(r.URL.Path, "/stream") {
 				next.ServeHTTP(w, r)
-			} else {
-				logger.Warn("global rate limit exceeded", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusTooManyRequests)
-				json.NewEncoder(w).Encode(ErrorResponse{"We are a bit busy right now. Please try again later."})
 				return
 			}
+
+			start := time.Now()
+			next.ServeHTTP(w, r)
+			recorder.Latency(time.Since(start))
 		})
-	}, limiter, nil
+	}
 }
 
-func MakePerClientRateLimitMiddleware(logger *slog.Logger, storageType StorageType, cap int, limit int, window, ttl time.Duration) (Middleware, *PerClientRateLimiter, error) {
-	limiter, err := NewPerClientRateLimiter(storageType, cap, limit, window, ttl)
-	if err != nil {
-		return nil, nil, err
+// MakeAdminMiddleware restricts a route to requests carrying the admin key as a
+// bearer token. Admin routes answer 404 when no admin key is configured.
+func MakeAdminMiddleware(logger *slog.Logger, adminApiKey string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if adminApiKey == "" {
+				http.NotFound(w, r)
+				return
+			}
+
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminApiKey)) != 1 {
+				logger.Warn("unauthorized admin request", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(&ErrorResponse{"Invalid admin credentials."})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
 	}
+}
 
+// MakeCustomScenarioMiddleware puts stress tests given as a single scenario in
+// the query behind the admin key, since they pick their own load. Suites are
+// files on the server and stay public.
+func MakeCustomScenarioMiddleware(logger *slog.Logger, adminApiKey string) Middleware {
+	adminOnly := MakeAdminMiddleware(logger, adminApiKey)
 	return func(next http.Handler) http.Handler {
+		admin := adminOnly(next)
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			var errorMessage string
-
-			//Clients identifed by combination of IP and API key
-			for _, route := range routesLimitedPerClient {
-				if r.URL.Path == route {
-					ip, _, err := net.SplitHostPort(r.RemoteAddr)
-					if err != nil {
-						ip = r.RemoteAddr
-					}
-
-					apiKey := r.Header.Get("X-API-Key")
-					if apiKey == "" {
-						logger.Warn("invalid API key provided", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
-						w.Header().Set("Content-Type", "application/json")
-						w.WriteHeader(http.StatusUnauthorized)
-						errorMessage = "Invalid API key provided."
-						json.NewEncoder(w).Encode(&ErrorResponse{errorMessage})
-						return
-					}
-
-					clientId := fmt.Sprintf("%s:%s", ip, apiKey)
-
-					if storageFull, err := limiter.Allow(clientId); err != nil {
-						if storageFull {
-							errorMessage = "We are a bit busy right now. Please try again later."
-							logger.Warn("per-client rate limiter storage full", "client_id", clientId, "path", r.URL.Path)
-						} else {
-							errorMessage = "Rate limit exceeded. Please try again later"
-							logger.Warn("per-client rate limit exceeded", "client_id", clientId, "path", r.URL.Path)
-						}
-
-						w.Header().Set("Content-Type", "application/json")
-						w.WriteHeader(http.StatusTooManyRequests)
-						json.NewEncoder(w).Encode(&ErrorResponse{errorMessage})
-						return
-					}
-
-				}
+			if r.URL.Query().Has("path") {
+				admin.ServeHTTP(w, r)
+				return
 			}
-
 			next.ServeHTTP(w, r)
 		})
-	}, limiter, nil
+	}
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/dessources/go_rate_limiter/ratelimit"
+)
+
+var limitName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// NamedLimit is a sliding window other services can check and consume
+// through /api/ratelimit, e.g. {"name": "partner-calls", "limit": 100, "window": "1m"}.
+type NamedLimit struct {
+	Name   string   `json:"name"`
+	Limit  int      `json:"limit"`
+	Window Duration `json:"window"`
+}
+
+// LoadNamedLimits reads a JSON list of named limits from path and builds
+// their limiters. A missing file means no named limits.
+func LoadNamedLimits(path string, storageType StorageType, cap int) (map[string]*ratelimit.PerClientRateLimiter, error) {
+	limiters := make(map[string]*ratelimit.PerClientRateLimiter)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return limiters, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var limits []NamedLimit
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return nil, fmt.Errorf("Named limits are not valid JSON: %v", err)
+	}
+
+	for _, limit := range limits {
+		err := func() error {
+			if !limitName.MatchString(limit.Name) {
+				return fmt.Errorf("Limit name %q may only contain letters, digits, '.', '-' and '_'.", limit.Name)
+			}
+			if _, exists := limiters[limit.Name]; exists {
+				return fmt.Errorf("Limit %q is configured twice.", limit.Name)
+			}
+			window := time.Duration(limit.Window)
+			limiter, err := newPerClientRateLimiter(storageType, cap, limit.Limit, window, window)
+			if err != nil {
+				return fmt.Errorf("Limit %q: %w", limit.Name, err)
+			}
+			limiters[limit.Name] = limiter
+			return nil
+		}()
+		if err != nil {
+			OfflineNamedLimits(limiters)
+			return nil, err
+		}
+	}
+	return limiters, nil
+}
+
+func OfflineNamedLimits(limiters map[string]*ratelimit.PerClientRateLimiter) {
+	for _, limiter := range limiters {
+		limiter.Offline()
+	}
+}
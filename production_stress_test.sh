@@ -1,159 +0,0 @@
-#!/bin/bash
-
-# Rate Limiter Stress Test Suite
-# Tests global rate limiting (token bucket) and per-client limiting (sliding window)
-
-PORT=${1:-8091}
-
-BASE_URL="http://localhost:$PORT"
-
-echo "Spinning up new test server on port $PORT..."
-
-# Keep trying until the server returns a 200 OK
-# -s: Silent mode
-# -f: Fail silently (returns non-zero exit code on 4xx/5xx)
-# -o /dev/null: Throw away the response body
-
-MAX_RETRIES=30
-COUNT=0
-
-while ! curl -s -f "$BASE_URL/" > /dev/null; do
-    if [ $COUNT -eq $MAX_RETRIES ]; then
-        echo "Error: Test server failed to start within 30 seconds."
-        exit 1
-    fi
-    
-    echo -n "." # Progress dots
-    sleep 1
-    ((COUNT++))
-done
-
-echo ""
-echo "✅ Server is up! Starting Stress Test Suite..."
-echo ""
-echo "=== Rate Limiter Stress Test Suite ==="
-echo "Targeting : $BASE_URL"
-echo ""
-
-# ============================================
-# Test 1: Index route (global limit only)
-# ============================================
-echo "--- Test 1: Index route (global limit only) ---"
-hey -n 100000 -c 30 -t 5 "$BASE_URL/" 2>/dev/null | grep -E "responses|Status"
-echo ""
-
-# # ============================================
-# # Test 2: Missing API key (should return 401)
-# # ============================================
-echo "--- Test 2: Missing API key on protected route ---"
-curl -X POST -s -w "Status: %{http_code}\n" \
-      -H "Content-Type: application/json" \
-      -d '{"original":"https://example.com"}' \
-      "$BASE_URL/api/shorten"
-
-echo ""
-
-# ============================================
-# Test 3: POST /api/shorten - create a short URL to example.com
-# ============================================
-echo "--- Test 3: Create short URL to example.com ---"
-SHORTEN_RESPONSE=$(curl -s -X POST \
-  -H "X-API-Key: testclient1" \
-  -H "Content-Type: application/json" \
-  -d '{"original":"https://example.com"}' \
-  "$BASE_URL/api/shorten")
-echo "Response: $SHORTEN_RESPONSE"
-
-# Extract short URL code from response (assumes format "Short URL: XXXXXXXXXX")
-# SHORT_CODE=$(echo "$SHORTEN_RESPONSE" | grep -oE ':"[A-Za-z0-9]{4}' | head -1)
-SHORT_CODE=$(echo "$SHORTEN_RESPONSE" | sed -n 's/.*"shortCode":"\([^"]*\)".*/\1/p')
-
-echo "Extracted short code: $SHORT_CODE"
-echo ""
-
-# ============================================
-# Test 4: GET /{shortUrl} - retrieve and redirect to example.com
-# ============================================
-echo "--- Test 4: Retrieve short URL (should redirect to example.com ) ---"
-curl -s -w "Status: %{http_code}\n" -H "X-API-Key: testclient1" -L "$BASE_URL/$SHORT_CODE" | head -5
-echo ""
-
-# ============================================
-# Test 5: Per-client rate limit test
-# Exceed per-client limit with rapid requests from same client
-# ============================================
-echo "--- Test 5: Per-client rate limit (single client burst) ---"
-echo "Sending 30 rapid requests from same API key..."
-hey -n 30 -c 5 -t 5 \
-  -H "X-API-Key: burstclient" \
-  -m POST \
-  -H "Content-Type: application/json" \
-  -d '{"original":"https://example.com/burst-test"}' \
-  "$BASE_URL/api/shorten" 2>/dev/null | grep -E "responses|Status"
-echo ""
-
-# ============================================
-# Test 6: Multiple clients (each within their limit)
-# ============================================
-echo "--- Test 6: Multiple clients (sequential, within limits) ---"
-for i in {1..5}; do
-  echo "Client $i:"
-  hey -n 10 -c 2 -t 5 \
-    -H "X-API-Key: client$i" \
-    -m POST \
-    -H "Content-Type: application/json" \
-    -d "{\"original\":\"https://example.com/client$i\"}" \
-    "$BASE_URL/api/shorten" 2>/dev/null | grep -E "responses|Status"
-done
-echo ""
-
-# ============================================
-# Test 7: Global rate limit exhaustion
-# Many concurrent requests to overwhelm global bucket
-# ============================================
-echo "--- Test 7: Global rate limit stress test ---"
-hey -n 200 -c 20 -t 5 \
-  -H "X-API-Key: stressclient" \
-  -m POST \
-  -H "Content-Type: application/json" \
-  -d '{"original":"https://example.com/stress"}' \
-  "$BASE_URL/api/shorten" 2>/dev/null | grep -E "responses|Status"
-echo ""
-
-# ============================================
-# Test 8: Recovery after exhaustion
-# ============================================
-echo "--- Test 8: Recovery after rate limit (wait 3s) ---"
-sleep 3
-hey -n 20 -c 5 -t 5 \
-  -H "X-API-Key: recoveryclient" \
-  -m POST \
-  -H "Content-Type: application/json" \
-  -d '{"original":"https://example.com/recovery"}' \
-  "$BASE_URL/api/shorten" 2>/dev/null | grep -E "responses|Status"
-echo ""
-
-# ============================================
-# Test 9: Invalid URL validation
-# ============================================
-echo "--- Test 9: Invalid URL (should return 400) ---"
-curl -s -w "\nStatus: %{http_code}\n" -X POST \
-  -H "X-API-Key: testclient1" \
-  -H "Content-Type: application/json" \
-  -d '{"original":"not-a-valid-url"}' \
-  "$BASE_URL/api/shorten"
-echo ""
-
-echo "--- Test 10: Invalid scheme (should return 400) ---"
-curl -s -w "\nStatus: %{http_code}\n" -X POST \
-  -H "X-API-Key: testclient1" \
-  -H "Content-Type: application/json" \
-  -d '{"original":"ftp://example.com/file"}' \
-  "$BASE_URL/api/shorten"
-echo ""
-
-# ============================================
-# Cleanup
-# ============================================
-echo "=== Tests Complete ==="
-echo "Done."
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dessources/go_rate_limiter/ratelimit"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+)
+
+// ProxyConfig describes the routes served in proxy mode. Global, when set,
+// is a token bucket shared by every route on top of their own policies.
+type ProxyConfig struct {
+	Global *ProxyGlobalPolicy `json:"global,omitempty"`
+	Routes []ProxyRoute       `json:"routes"`
+}
+
+type ProxyRoute struct {
+	Name        string             `json:"name"`
+	Pattern     string             `json:"pattern"`               // http.ServeMux pattern, e.g. "/legacy/" or "GET api.example.com/"
+	StripPrefix string             `json:"stripPrefix,omitempty"` // removed from the path before forwarding
+	Upstreams   []string           `json:"upstreams"`             // tried in turn, skipping unhealthy ones
+	Global      *ProxyGlobalPolicy `json:"global,omitempty"`
+	PerClient   *ProxyClientPolicy `json:"perClient,omitempty"`
+	Shadow      *ProxyShadowPolicy `json:"shadow,omitempty"` // evaluated next to the policies above, never refuses
+	HealthCheck *ProxyHealthCheck  `json:"healthCheck,omitempty"`
+}
+
+// A policy with Shadow set lets every request through and only logs the
+// ones it would have refused.
+type ProxyGlobalPolicy struct {
+	Capacity      int  `json:"capacity"`
+	RatePerMinute int  `json:"ratePerMinute"`
+	Shadow        bool `json:"shadow,omitempty"`
+}
+
+type ProxyClientPolicy struct {
+	Limit  int      `json:"limit"`
+	Window Duration `json:"window"`
+	// Key is "ip" (default), "apiKey" for the IP and X-API-Key pair used by
+	// the shortener, or "header:<name>"
+	Key    string `json:"key,omitempty"`
+	Shadow bool   `json:"shadow,omitempty"`
+}
+
+// ProxyShadowPolicy holds the policies a route tries out before enforcing
+// them, they are always in shadow mode.
+type ProxyShadowPolicy struct {
+	Global    *ProxyGlobalPolicy `json:"global,omitempty"`
+	PerClient *ProxyClientPolicy `json:"perClient,omitempty"`
+}
+
+type ProxyHealthCheck struct {
+	Path     string   `json:"path"`
+	Interval Duration `json:"interval,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+}
+
+func LoadProxyConfig(path string) (*ProxyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg ProxyConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("Proxy config is not valid JSON: %v", err)
+	}
+	if len(cfg.Routes) == 0 {
+		return nil, errors.New("Proxy config has no routes.")
+	}
+	for i := range cfg.Routes {
+		route := &cfg.Routes[i]
+		if route.Name == "" {
+			route.Name = route.Pattern
+		}
+		if route.Pattern == "" || len(route.Upstreams) == 0 {
+			return nil, fmt.Errorf("Route %q needs a pattern and at least one upstream.", route.Name)
+		}
+		if route.PerClient != nil {
+			if _, err := proxyKeyFunc(route.PerClient.Key, ClientMask{}); err != nil {
+				return nil, fmt.Errorf("Route %q: %w", route.Name, err)
+			}
+		}
+		if route.Shadow != nil {
+			if route.Shadow.Global != nil {
+				route.Shadow.Global.Shadow = true
+			}
+			if route.Shadow.PerClient != nil {
+				route.Shadow.PerClient.Shadow = true
+				if _, err := proxyKeyFunc(route.Shadow.PerClient.Key, ClientMask{}); err != nil {
+					return nil, fmt.Errorf("Route %q: %w", route.Name, err)
+				}
+			}
+		}
+	}
+	return &cfg, nil
+}
+
+// proxyKeyFunc builds the key of a per-client policy, IPs are masked with mask.
+func proxyKeyFunc(key string, mask ClientMask) (ratelimit.KeyFunc, error) {
+	switch {
+	case key == "" || key == "ip":
+		return mask.ClientIP(), nil
+	case key == "apiKey":
+		return mask.ClientId, nil
+	case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+		return ratelimit.HeaderKey(strings.TrimPrefix(key, "header:")), nil
+	}
+	return nil, fmt.Errorf("Unknown client key %q, expected ip, apiKey or header:<name>.", key)
+}
+
+type upstream struct {
+	target  *url.URL
+	healthy atomic.Bool
+}
+
+// upstreamPool hands out healthy upstreams in turn and keeps their health
+// up to date when a health check is configured.
+type upstreamPool struct {
+	upstreams []*upstream
+	next      atomic.Uint64
+}
+
+func newUpstreamPool(rawUrls []string) (*upstreamPool, error) {
+	pool := &upstreamPool{}
+	for _, raw := range rawUrls {
+		target, err := url.Parse(raw)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("Invalid upstream url %q.", raw)
+		}
+		u := &upstream{target: target}
+		u.healthy.Store(true)
+		pool.upstreams = append(pool.upstreams, u)
+	}
+	return pool, nil
+}
+
+// pick returns the next healthy upstream other than skip, or nil when none is.
+func (p *upstreamPool) pick(skip *upstream) *upstream {
+	start := p.next.Add(1)
+	for i := range uint64(len(p.upstreams)) {
+		u := p.upstreams[(start+i)%uint64(len(p.upstreams))]
+		if u != skip && u.healthy.Load() {
+			return u
+		}
+	}
+	return nil
+}
+
+// watch probes every upstream until ctx ends. An upstream is healthy while
+// its health path answers with a 2xx or 3xx.
+func (p *upstreamPool) watch(ctx context.Context, logger *slog.Logger, route string, check ProxyHealthCheck) {
+	interval := time.Duration(check.Interval)
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	timeout := time.Duration(check.Timeout)
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	client := &http.Client{Timeout: timeout, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	probe := func() {
+		for _, u := range p.upstreams {
+			healthy := probeUpstream(ctx, client, u.target.JoinPath(check.Path).String())
+			if was := u.healthy.Swap(healthy); was != healthy {
+				logger.Warn("upstream health changed", "route", route, "upstream", u.target.String(), "healthy", healthy)
+			}
+		}
+	}
+
+	probe()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			probe()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func probeUpstream(ctx context.Context, client *http.Client, target string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 400
+}
+
+// proxyAttempt is one try at forwarding a request to an upstream. A failed
+// attempt that can be retried keeps its error instead of answering.
+type proxyAttempt struct {
+	upstream *upstream
+	retry    bool
+	err      error
+}
+
+type proxyAttemptKey struct{}
+
+// isRetryable reports whether r can be sent again to another upstream: it
+// is idempotent, has no body to replay and is not a protocol upgrade.
+func isRetryable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return (r.Body == nil || r.Body == http.NoBody) && r.Header.Get("Upgrade") == ""
+	}
+	return false
+}
+
+// newRouteProxy forwards to the upstream picked for the request. Responses
+// are flushed as they arrive so event streams and long polls pass through,
+// and upgraded connections such as WebSockets are tunnelled. Idempotent
+// requests that fail to reach their upstream are tried once on another.
+func newRouteProxy(logger *slog.Logger, route ProxyRoute, pool *upstreamPool) http.Handler {
+	badGateway := func(w http.ResponseWriter, r *http.Request, u *upstream, err error) {
+		logger.Error("upstream request failed", "route", route.Name, "upstream", u.target.String(), "path", r.URL.Path, "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(&ErrorResponse{"The upstream service could not be reached."})
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			attempt := pr.In.Context().Value(proxyAttemptKey{}).(*proxyAttempt)
+			pr.SetURL(attempt.upstream.target)
+			pr.SetXForwarded()
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			attempt := r.Context().Value(proxyAttemptKey{}).(*proxyAttempt)
+			if attempt.retry && r.Context().Err() == nil {
+				attempt.err = err
+				return
+			}
+			badGateway(w, r, attempt.upstream, err)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := pool.pick(nil)
+		if u == nil {
+			logger.Warn("no healthy upstream", "route", route.Name, "path", r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(&ErrorResponse{"The upstream service is unavailable. Please try again later."})
+			return
+		}
+
+		if route.StripPrefix != "" {
+			r = r.Clone(r.Context())
+			r.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(r.URL.Path, route.StripPrefix), "/")
+			r.URL.RawPath = ""
+		}
+
+		attempt := &proxyAttempt{upstream: u, retry: isRetryable(r)}
+		proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyAttemptKey{}, attempt)))
+		if attempt.err == nil {
+			return
+		}
+
+		// the upstream may be down without its health check noticing yet
+		next := pool.pick(u)
+		if next == nil {
+			badGateway(w, r, u, attempt.err)
+			return
+		}
+		logger.Warn("upstream request failed, retrying on another upstream", "route", route.Name, "upstream", u.target.String(), "retry_upstream", next.target.String(), "path", r.URL.Path, "error", attempt.err)
+		proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyAttemptKey{}, &proxyAttempt{upstream: next})))
+	})
+}
+
+// sharedProxyRoute names the global policy shared by every route.
+const sharedProxyRoute = "*"
+
+// routeGlobalLimitKey marks requests of a route with its own enforced global
+// policy. That policy records their global decision, so requests it lets
+// through are not counted a second time by the shared one.
+type routeGlobalLimitKey struct{}
+
+// makeProxyLimiters builds the middlewares of a policy, their decisions are
+// counted by recorder. The returned offline function stops the limiters.
+func makeProxyLimiters(logger *slog.Logger, recorder *MetricsRecorder, cfg *Config, route string, global *ProxyGlobalPolicy, perClient *ProxyClientPolicy) ([]Middleware, func(), error) {
+	var middlewares []Middleware
+	var offline []func()
+	stop := func() {
+		for _, f := range offline {
+			f()
+		}
+	}
+
+	if global != nil {
+		limiter, err := newGlobalRateLimiter(cfg.StorageType, global.Capacity, global.Capacity, global.RatePerMinute)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Route %q: %w", route, err)
+		}
+		offline = append(offline, limiter.Offline)
+		middlewares = append(middlewares, ratelimit.GlobalMiddleware(limiter, ratelimit.GlobalMiddlewareOptions{
+			Skip: isExemptFromLimits,
+			OnReject: func(w http.ResponseWriter, r *http.Request, rejection ratelimit.Rejection) {
+				logger.Warn("global rate limit exceeded", "route", route, "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+				ratelimit.DefaultRejectHandler(w, r, rejection)
+			},
+			OnDecision: func(r *http.Request, allowed bool) {
+				if global.Shadow {
+					return
+				}
+				if allowed && route == sharedProxyRoute && r.Context().Value(routeGlobalLimitKey{}) != nil {
+					return
+				}
+				recorder.GlobalLimit(allowed)
+			},
+			Shadow: global.Shadow,
+			OnShadowReject: func(r *http.Request, rejection ratelimit.Rejection) {
+				logger.Info("shadow global rate limit exceeded", "route", route, "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+				recorder.GlobalShadowRejected()
+			},
+		}))
+	}
+
+	if perClient != nil {
+		keyFunc, err := proxyKeyFunc(perClient.Key, cfg.ClientMask)
+		if err != nil {
+			stop()
+			return nil, nil, err
+		}
+		window := time.Duration(perClient.Window)
+		limiter, err := newPerClientRateLimiter(cfg.StorageType, cfg.PerClientLimiterCap, perClient.Limit, window, window)
+		if err != nil {
+			stop()
+			return nil, nil, fmt.Errorf("Route %q: %w", route, err)
+		}
+		offline = append(offline, limiter.Offline)
+		middlewares = append(middlewares, ratelimit.PerClientMiddleware(limiter, ratelimit.PerClientMiddlewareOptions{
+			Key:  keyFunc,
+			Skip: isExemptFromLimits,
+			OnReject: func(w http.ResponseWriter, r *http.Request, rejection ratelimit.Rejection) {
+				logger.Warn("per-client rate limit exceeded", "route", route, "client_id", rejection.Key, "reason", rejection.Reason, "path", r.URL.Path)
+				ratelimit.DefaultRejectHandler(w, r, rejection)
+			},
+			OnDecision: func(r *http.Request, key string, allowed bool) {
+				if !perClient.Shadow {
+					recorder.PerClientLimit(key, allowed)
+				}
+			},
+			Shadow: perClient.Shadow,
+			OnShadowReject: func(r *http.Request, rejection ratelimit.Rejection) {
+				logger.Info("shadow per-client rate limit exceeded", "route", route, "client_id", rejection.Key, "reason", rejection.Reason, "path", r.URL.Path)
+				if rejection.Reason != ratelimit.ReasonMissingKey {
+					recorder.PerClientShadowRejected(rejection.Key)
+				}
+			},
+		}))
+	}
+
+	return middlewares, stop, nil
+}
+
+// NewProxyHandler routes requests to the upstreams of the matching route,
+// through the shared global limiter and then the route's own limiters, whose
+// decisions are counted by recorder. Health checks run until ctx ends, the
+// returned function stops the limiters.
+func NewProxyHandler(ctx context.Context, logger *slog.Logger, recorder *MetricsRecorder, cfg *Config, proxyCfg *ProxyConfig) (http.Handler, func(), error) {
+	var offline []func()
+	stop := func() {
+		for _, f := range offline {
+			f()
+		}
+	}
+
+	shared, stopShared, err := makeProxyLimiters(logger, recorder, cfg, sharedProxyRoute, proxyCfg.Global, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	offline = append(offline, stopShared)
+
+	mux := http.NewServeMux()
+	for _, route := range proxyCfg.Routes {
+		pool, err := newUpstreamPool(route.Upstreams)
+		if err != nil {
+			stop()
+			return nil, nil, fmt.Errorf("Route %q: %w", route.Name, err)
+		}
+		if route.HealthCheck != nil {
+			go pool.watch(ctx, logger, route.Name, *route.HealthCheck)
+		}
+
+		middlewares, stopRoute, err := makeProxyLimiters(logger, recorder, cfg, route.Name, route.Global, route.PerClient)
+		if err != nil {
+			stop()
+			return nil, nil, err
+		}
+		offline = append(offline, stopRoute)
+
+		if route.Shadow != nil {
+			shadow, stopShadow, err := makeProxyLimiters(logger, recorder, cfg, route.Name, route.Shadow.Global, route.Shadow.PerClient)
+			if err != nil {
+				stop()
+				return nil, nil, err
+			}
+			offline = append(offline, stopShadow)
+			//shadow limiters go first so they see the requests the enforced ones refuse
+			middlewares = append(shadow, middlewares...)
+		}
+
+		var handler http.Handler = newRouteProxy(logger, route, pool)
+		if chain := append(append([]Middleware{}, shared...), middlewares...); len(chain) > 0 {
+			handler = ComposeMiddlewares(chain...)(handler)
+		}
+		if len(shared) > 0 && route.Global != nil && !route.Global.Shadow {
+			handler = markRouteGlobalLimit(handler)
+		}
+
+		if err := registerProxyRoute(mux, route.Pattern, handler); err != nil {
+			stop()
+			return nil, nil, fmt.Errorf("Route %q: %w", route.Name, err)
+		}
+	}
+
+	return mux, stop, nil
+}
+
+// markRouteGlobalLimit tells the shared global policy that the route's own
+// records the decision of the requests it lets through.
+func markRouteGlobalLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeGlobalLimitKey{}, true)))
+	})
+}
+
+// registerProxyRoute turns the panic of an invalid or conflicting pattern into an error.
+func registerProxyRoute(mux *http.ServeMux, pattern string, handler http.Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	mux.Handle(pattern, handler)
+	return nil
+}
+
+// RunProxy serves cfg.ProxyConfigPath on cfg.ServerAddr until SIGINT or
+// SIGTERM. When cfg.ProxyMetricsPath is set, the limiters' decisions, shadow
+// ones included, are streamed there to admins, ahead of the routes. The
+// access lists apply to every request, as in shortener mode.
+func RunProxy(logger *slog.Logger, cfg *Config) error {
+	proxyCfg, err := LoadProxyConfig(cfg.ProxyConfigPath)
+	if err != nil {
+		return err
+	}
+
+	accessLists, err := NewAccessLists(cfg.AccessLists, cfg.ClientMask)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	metrics := NewMetricsRecorder()
+	handler, stop, err := NewProxyHandler(ctx, logger, metrics, cfg, proxyCfg)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	if cfg.ProxyMetricsPath != "" {
+		metricsHub := NewMetricsHub(logger, func() Metrics {
+			point := Metrics{Timestamp: time.Now()}
+			metrics.Collect(&point)
+			return point
+		}, cfg.MetricsMaxSubscribers, cfg.MetricsHistorySize)
+		defer metricsHub.Offline()
+
+		stream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			streamMetrics(logger, metricsHub, w, r)
+		})
+		if err := registerProxyRoute(mux, "GET "+cfg.ProxyMetricsPath, MakeAdminMiddleware(logger, cfg.AdminApiKey)(stream)); err != nil {
+			return fmt.Errorf("PROXY_METRICS_PATH: %w", err)
+		}
+	}
+	//allow and deny lists are checked before any limiter
+	handler = MakeAccessListMiddleware(logger, accessLists)(mux)
+
+	// no write timeout, streamed responses stay open as long as the upstream keeps them
+	server := &http.Server{Addr: cfg.ServerAddr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	idleConnsClosed := make(chan struct{})
+	EnableGracefulShutdown(logger, idleConnsClosed, server, cancel)
+
+	logger.Info("proxy starting", "addr", cfg.ServerAddr, "routes", len(proxyCfg.Routes))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	<-idleConnsClosed
+	logger.Info("proxy stopped gracefully")
+	return nil
+}
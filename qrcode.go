@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	QRFormatPNG = "png"
+	QRFormatSVG = "svg"
+
+	defaultQRSize   = 256
+	minQRSize       = 64
+	defaultQRMargin = 4 // quiet zone recommended by the QR spec, in modules
+	maxQRMargin     = 16
+)
+
+var qrRecoveryLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+type QROptions struct {
+	Format string
+	Size   int // pixels per side
+	Level  qrcode.RecoveryLevel
+	Margin int // quiet zone in modules
+}
+
+// ParseQROptions reads format, size, level and margin from the query string,
+// falling back to a 256px PNG with medium error correction and a 4 module margin.
+func ParseQROptions(query url.Values, cfg *Config) (QROptions, string, bool) {
+	opts := QROptions{Format: QRFormatPNG, Size: defaultQRSize, Level: qrcode.Medium, Margin: defaultQRMargin}
+
+	if format := strings.ToLower(query.Get("format")); format != "" {
+		if format != QRFormatPNG && format != QRFormatSVG {
+			return opts, "Format must be png or svg", false
+		}
+		opts.Format = format
+	}
+
+	if size := query.Get("size"); size != "" {
+		value, err := strconv.Atoi(size)
+		if err != nil || value < minQRSize || value > cfg.MaxQRSize {
+			return opts, fmt.Sprintf("Size must be between %d and %d pixels", minQRSize, cfg.MaxQRSize), false
+		}
+		opts.Size = value
+	}
+
+	if level := strings.ToUpper(query.Get("level")); level != "" {
+		value, ok := qrRecoveryLevels[level]
+		if !ok {
+			return opts, "Error correction level must be one of L, M, Q or H", false
+		}
+		opts.Level = value
+	}
+
+	if margin := query.Get("margin"); margin != "" {
+		value, err := strconv.Atoi(margin)
+		if err != nil || value < 0 || value > maxQRMargin {
+			return opts, fmt.Sprintf("Margin must be between 0 and %d modules", maxQRMargin), false
+		}
+		opts.Margin = value
+	}
+
+	return opts, "", true
+}
+
+var ErrQRSizeTooSmall = errors.New("Requested size is too small for this code.")
+
+// RenderQRCode encodes content and returns the image along with its content type.
+func RenderQRCode(content string, opts QROptions) ([]byte, string, error) {
+	code, err := qrcode.New(content, opts.Level)
+	if err != nil {
+		return nil, "", err
+	}
+	code.DisableBorder = true // the margin is drawn below so its width is configurable
+	modules := code.Bitmap()
+
+	if opts.Format == QRFormatSVG {
+		return renderQRCodeSVG(modules, opts), "image/svg+xml", nil
+	}
+
+	data, err := renderQRCodePNG(modules, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, "image/png", nil
+}
+
+func renderQRCodePNG(modules [][]bool, opts QROptions) ([]byte, error) {
+	total := len(modules) + 2*opts.Margin
+	scale := opts.Size / total
+	if scale < 1 {
+		return nil, ErrQRSizeTooSmall
+	}
+	// center the code when size isn't a multiple of the module count
+	offset := (opts.Size-total*scale)/2 + opts.Margin*scale
+
+	img := image.NewPaletted(image.Rect(0, 0, opts.Size, opts.Size), color.Palette{color.White, color.Black})
+	for y, row := range modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := range scale {
+				for dx := range scale {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func renderQRCodeSVG(modules [][]bool, opts QROptions) []byte {
+	total := len(modules) + 2*opts.Margin
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, opts.Size, opts.Size, total, total)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, total, total)
+	for y, row := range modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+opts.Margin, y+opts.Margin)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
@@ -0,0 +1,119 @@
+package envoyrls
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+)
+
+// DomainConfig follows the layout of Envoy's reference rate limit service:
+// descriptors nest the same way as the entries Envoy sends, and a rule
+// without a value matches any value of its key.
+//
+//	[{"domain": "gateway", "descriptors": [
+//	  {"key": "remote_address", "rateLimit": {"unit": "minute", "requestsPerUnit": 60}},
+//	  {"key": "path", "value": "/login", "descriptors": [
+//	    {"key": "remote_address", "rateLimit": {"unit": "second", "requestsPerUnit": 1}}
+//	  ]}
+//	]}]
+type DomainConfig struct {
+	Domain      string             `json:"domain"`
+	Descriptors []DescriptorConfig `json:"descriptors"`
+}
+
+type DescriptorConfig struct {
+	Key         string             `json:"key"`
+	Value       string             `json:"value,omitempty"`
+	RateLimit   *RateLimitConfig   `json:"rateLimit,omitempty"`
+	Descriptors []DescriptorConfig `json:"descriptors,omitempty"`
+}
+
+type RateLimitConfig struct {
+	Name            string `json:"name,omitempty"`
+	Unit            string `json:"unit"`
+	RequestsPerUnit int    `json:"requestsPerUnit"`
+}
+
+var units = map[string]struct {
+	window time.Duration
+	proto  rlsv3.RateLimitResponse_RateLimit_Unit
+}{
+	"second": {time.Second, rlsv3.RateLimitResponse_RateLimit_SECOND},
+	"minute": {time.Minute, rlsv3.RateLimitResponse_RateLimit_MINUTE},
+	"hour":   {time.Hour, rlsv3.RateLimitResponse_RateLimit_HOUR},
+	"day":    {24 * time.Hour, rlsv3.RateLimitResponse_RateLimit_DAY},
+}
+
+// LoadConfig reads a JSON list of domain configs from path.
+func LoadConfig(path string) ([]DomainConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var domains []DomainConfig
+	if err := json.Unmarshal(data, &domains); err != nil {
+		return nil, fmt.Errorf("Rate limit config is not valid JSON: %v", err)
+	}
+	return domains, nil
+}
+
+func (c RateLimitConfig) validate(path string) error {
+	if _, ok := units[strings.ToLower(c.Unit)]; !ok {
+		return fmt.Errorf("%s: unit must be second, minute, hour or day.", path)
+	}
+	if c.RequestsPerUnit <= 0 {
+		return fmt.Errorf("%s: requestsPerUnit must be a non-zero positive integer.", path)
+	}
+	return nil
+}
+
+func validateDescriptors(descriptors []DescriptorConfig, parent string) error {
+	seen := make(map[string]bool)
+	for _, d := range descriptors {
+		if d.Key == "" {
+			return fmt.Errorf("%s: descriptor without a key.", parent)
+		}
+		path := fmt.Sprintf("%s/%s=%s", parent, d.Key, d.Value)
+		if seen[d.Key+"="+d.Value] {
+			return fmt.Errorf("%s: duplicate descriptor.", path)
+		}
+		seen[d.Key+"="+d.Value] = true
+
+		if d.RateLimit == nil && len(d.Descriptors) == 0 {
+			return fmt.Errorf("%s: descriptor needs a rateLimit or nested descriptors.", path)
+		}
+		if d.RateLimit != nil {
+			if err := d.RateLimit.validate(path); err != nil {
+				return err
+			}
+		}
+		if err := validateDescriptors(d.Descriptors, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateDomains(domains []DomainConfig) error {
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		if domain.Domain == "" {
+			return errors.New("Every rate limit domain needs a name.")
+		}
+		if seen[domain.Domain] {
+			return fmt.Errorf("Rate limit domain %q is configured twice.", domain.Domain)
+		}
+		seen[domain.Domain] = true
+
+		if err := validateDescriptors(domain.Descriptors, domain.Domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
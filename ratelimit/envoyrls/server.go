@@ -0,0 +1,223 @@
+// Package envoyrls serves the ratelimit limiters over Envoy's rate limit
+// service API, so an Envoy gateway can use them through its ratelimit filter.
+package envoyrls
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dessources/go_rate_limiter/ratelimit"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	commonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// LimiterFunc builds the limiter behind one configured rate limit.
+type LimiterFunc func(limit int, window time.Duration) (*ratelimit.PerClientRateLimiter, error)
+
+type Options struct {
+	NewLimiter LimiterFunc                            // defaults to in-memory limiters tracking up to Capacity keys
+	Capacity   int                                    // keys tracked per rate limit, defaults to 50000
+	OnDecision func(domain, key string, allowed bool) // called for every descriptor that matched a limit
+}
+
+type rule struct {
+	limit    *rlsv3.RateLimitResponse_RateLimit
+	limiter  *ratelimit.PerClientRateLimiter
+	children map[string]*rule // by "key=value", "key=" matches any value
+}
+
+// Server implements the RateLimitService ShouldRateLimit API. Each
+// descriptor is matched against the configured rules, and the values of its
+// entries form the client key counted against the matched rule's limiter.
+type Server struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+	domains    map[string]map[string]*rule
+	limiters   []*ratelimit.PerClientRateLimiter
+	onDecision func(domain, key string, allowed bool)
+}
+
+func NewServer(domains []DomainConfig, opts Options) (*Server, error) {
+	if err := validateDomains(domains); err != nil {
+		return nil, err
+	}
+
+	if opts.Capacity <= 0 {
+		opts.Capacity = 50000
+	}
+	if opts.NewLimiter == nil {
+		opts.NewLimiter = func(limit int, window time.Duration) (*ratelimit.PerClientRateLimiter, error) {
+			return ratelimit.NewPerClientRateLimiter(ratelimit.PerClientOptions{Limit: limit, Window: window, Capacity: opts.Capacity})
+		}
+	}
+
+	s := &Server{domains: make(map[string]map[string]*rule), onDecision: opts.OnDecision}
+	for _, domain := range domains {
+		rules, err := s.buildRules(domain.Descriptors, opts.NewLimiter)
+		if err != nil {
+			s.Offline()
+			return nil, err
+		}
+		s.domains[domain.Domain] = rules
+	}
+	return s, nil
+}
+
+func (s *Server) buildRules(descriptors []DescriptorConfig, newLimiter LimiterFunc) (map[string]*rule, error) {
+	rules := make(map[string]*rule, len(descriptors))
+	for _, d := range descriptors {
+		r := &rule{}
+		if d.RateLimit != nil {
+			unit := units[strings.ToLower(d.RateLimit.Unit)]
+			limiter, err := newLimiter(d.RateLimit.RequestsPerUnit, unit.window)
+			if err != nil {
+				return nil, err
+			}
+			s.limiters = append(s.limiters, limiter)
+			r.limiter = limiter
+			r.limit = &rlsv3.RateLimitResponse_RateLimit{Name: d.RateLimit.Name, RequestsPerUnit: uint32(d.RateLimit.RequestsPerUnit), Unit: unit.proto}
+		}
+
+		children, err := s.buildRules(d.Descriptors, newLimiter)
+		if err != nil {
+			return nil, err
+		}
+		r.children = children
+		rules[d.Key+"="+d.Value] = r
+	}
+	return rules, nil
+}
+
+// match walks the rules along the descriptor's entries. Every entry has to
+// match, and the last rule reached has to carry a limit.
+func (s *Server) match(domain string, entries []*commonv3.RateLimitDescriptor_Entry) *rule {
+	rules := s.domains[domain]
+	var matched *rule
+	for _, entry := range entries {
+		r, ok := rules[entry.Key+"="+entry.Value]
+		if !ok {
+			r, ok = rules[entry.Key+"="]
+		}
+		if !ok {
+			return nil
+		}
+		matched, rules = r, r.children
+	}
+	if matched == nil || matched.limiter == nil {
+		return nil
+	}
+	return matched
+}
+
+func descriptorKey(domain string, entries []*commonv3.RateLimitDescriptor_Entry) string {
+	var b strings.Builder
+	b.WriteString(domain)
+	for _, entry := range entries {
+		b.WriteString("|")
+		b.WriteString(entry.Key)
+		b.WriteString("=")
+		b.WriteString(entry.Value)
+	}
+	return b.String()
+}
+
+// ShouldRateLimit counts the request against the limit of every descriptor
+// it matches. The request is OVER_LIMIT when any of them is, descriptors
+// without a matching limit are OK.
+func (s *Server) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	if req.Domain == "" {
+		return nil, status.Error(codes.InvalidArgument, "Rate limit domain must not be empty.")
+	}
+	if len(req.Descriptors) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Rate limit descriptor list must not be empty.")
+	}
+
+	hits := uint64(1)
+	if req.HitsAddend > 0 {
+		hits = uint64(req.HitsAddend)
+	}
+
+	response := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+	var tightest *rlsv3.RateLimitResponse_DescriptorStatus
+	var retryAfter time.Duration
+
+	for _, descriptor := range req.Descriptors {
+		r := s.match(req.Domain, descriptor.Entries)
+		if r == nil {
+			response.Statuses = append(response.Statuses, &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK})
+			continue
+		}
+
+		addend := hits
+		if descriptorAddend := descriptor.GetHitsAddend(); descriptorAddend != nil {
+			addend = descriptorAddend.Value
+		}
+		// anything above the limit is over it, clamping keeps huge addends
+		// from wrapping around to a negative cost
+		cost := int(min(addend, uint64(r.limiter.Limit())+1))
+
+		key := descriptorKey(req.Domain, descriptor.Entries)
+		var err error
+		if cost > 0 {
+			err = r.limiter.AllowN(key, cost)
+		}
+		if s.onDecision != nil {
+			s.onDecision(req.Domain, key, err == nil)
+		}
+
+		remaining, resetAt := r.limiter.Remaining(key)
+		descriptorStatus := &rlsv3.RateLimitResponse_DescriptorStatus{
+			Code:               rlsv3.RateLimitResponse_OK,
+			CurrentLimit:       r.limit,
+			LimitRemaining:     uint32(remaining),
+			DurationUntilReset: durationpb.New(max(time.Until(resetAt), 0)),
+		}
+		if err != nil {
+			descriptorStatus.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+			response.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+			if !errors.Is(err, ratelimit.ErrStoreFull) {
+				retryAfter = max(retryAfter, r.limiter.RetryAfter(key, cost))
+			}
+		}
+		if tightest == nil || descriptorStatus.LimitRemaining < tightest.LimitRemaining {
+			tightest = descriptorStatus
+		}
+		response.Statuses = append(response.Statuses, descriptorStatus)
+	}
+
+	if tightest != nil {
+		response.ResponseHeadersToAdd = limitHeaders(tightest, retryAfter)
+	}
+	return response, nil
+}
+
+// limitHeaders describes the most restrictive limit the request matched.
+func limitHeaders(tightest *rlsv3.RateLimitResponse_DescriptorStatus, retryAfter time.Duration) []*corev3.HeaderValue {
+	headers := []*corev3.HeaderValue{
+		{Key: "X-RateLimit-Limit", Value: strconv.Itoa(int(tightest.CurrentLimit.RequestsPerUnit))},
+		{Key: "X-RateLimit-Remaining", Value: strconv.Itoa(int(tightest.LimitRemaining))},
+		{Key: "X-RateLimit-Reset", Value: seconds(tightest.DurationUntilReset.AsDuration())},
+	}
+	if retryAfter > 0 {
+		headers = append(headers, &corev3.HeaderValue{Key: "Retry-After", Value: seconds(retryAfter)})
+	}
+	return headers
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Offline stops the cleanup goroutines of every limiter.
+func (s *Server) Offline() {
+	for _, limiter := range s.limiters {
+		limiter.Offline()
+	}
+}
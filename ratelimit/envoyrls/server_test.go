@@ -0,0 +1,249 @@
+package envoyrls
+
+import (
+	"context"
+	"math"
+	"net"
+	"testing"
+
+	commonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+var testDomains = []DomainConfig{{
+	Domain: "gateway",
+	Descriptors: []DescriptorConfig{
+		{Key: "remote_address", RateLimit: &RateLimitConfig{Unit: "minute", RequestsPerUnit: 3}},
+		{Key: "path", Value: "/login", Descriptors: []DescriptorConfig{
+			{Key: "remote_address", RateLimit: &RateLimitConfig{Unit: "hour", RequestsPerUnit: 1}},
+		}},
+	},
+}}
+
+// startServer serves a Server over an in-memory listener and returns a
+// client connected to it.
+func startServer(t *testing.T, domains []DomainConfig) rlsv3.RateLimitServiceClient {
+	t.Helper()
+	server, err := NewServer(domains, Options{})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(server.Offline)
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	rlsv3.RegisterRateLimitServiceServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+func descriptor(entries ...string) *commonv3.RateLimitDescriptor {
+	d := &commonv3.RateLimitDescriptor{}
+	for i := 0; i+1 < len(entries); i += 2 {
+		d.Entries = append(d.Entries, &commonv3.RateLimitDescriptor_Entry{Key: entries[i], Value: entries[i+1]})
+	}
+	return d
+}
+
+func headers(response *rlsv3.RateLimitResponse) map[string]string {
+	values := make(map[string]string)
+	for _, header := range response.ResponseHeadersToAdd {
+		values[header.Key] = header.Value
+	}
+	return values
+}
+
+func shouldRateLimit(t *testing.T, client rlsv3.RateLimitServiceClient, req *rlsv3.RateLimitRequest) *rlsv3.RateLimitResponse {
+	t.Helper()
+	response, err := client.ShouldRateLimit(context.Background(), req)
+	if err != nil {
+		t.Fatalf("ShouldRateLimit: %v", err)
+	}
+	return response
+}
+
+func TestShouldRateLimitOkThenOverLimit(t *testing.T) {
+	client := startServer(t, testDomains)
+	req := &rlsv3.RateLimitRequest{Domain: "gateway", Descriptors: []*commonv3.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")}}
+
+	for i := range 3 {
+		response := shouldRateLimit(t, client, req)
+		if response.OverallCode != rlsv3.RateLimitResponse_OK {
+			t.Fatalf("request %d: got %v, want OK", i+1, response.OverallCode)
+		}
+		if got := response.Statuses[0].LimitRemaining; got != uint32(2-i) {
+			t.Errorf("request %d: remaining %d, want %d", i+1, got, 2-i)
+		}
+	}
+
+	response := shouldRateLimit(t, client, req)
+	if response.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("got %v, want OVER_LIMIT", response.OverallCode)
+	}
+	if got := response.Statuses[0].Code; got != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("descriptor status %v, want OVER_LIMIT", got)
+	}
+
+	// other clients have their own window
+	req.Descriptors = []*commonv3.RateLimitDescriptor{descriptor("remote_address", "10.0.0.2")}
+	if response := shouldRateLimit(t, client, req); response.OverallCode != rlsv3.RateLimitResponse_OK {
+		t.Errorf("other client: got %v, want OK", response.OverallCode)
+	}
+}
+
+func TestShouldRateLimitNestedDescriptors(t *testing.T) {
+	client := startServer(t, testDomains)
+
+	tests := []struct {
+		name       string
+		descriptor *commonv3.RateLimitDescriptor
+		limited    bool
+		perUnit    uint32
+		secondCall rlsv3.RateLimitResponse_Code
+	}{
+		{"nested rule", descriptor("path", "/login", "remote_address", "10.0.0.1"), true, 1, rlsv3.RateLimitResponse_OVER_LIMIT},
+		{"other value of the parent", descriptor("path", "/home", "remote_address", "10.0.0.1"), false, 0, rlsv3.RateLimitResponse_OK},
+		{"parent without a limit", descriptor("path", "/login"), false, 0, rlsv3.RateLimitResponse_OK},
+		{"unknown domain entry", descriptor("user", "alice"), false, 0, rlsv3.RateLimitResponse_OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &rlsv3.RateLimitRequest{Domain: "gateway", Descriptors: []*commonv3.RateLimitDescriptor{tt.descriptor}}
+
+			response := shouldRateLimit(t, client, req)
+			if response.OverallCode != rlsv3.RateLimitResponse_OK {
+				t.Fatalf("first call: got %v, want OK", response.OverallCode)
+			}
+			limit := response.Statuses[0].CurrentLimit
+			if tt.limited != (limit != nil) {
+				t.Fatalf("matched a limit: %v, want %v", limit != nil, tt.limited)
+			}
+			if tt.limited && limit.RequestsPerUnit != tt.perUnit {
+				t.Errorf("requests per unit %d, want %d", limit.RequestsPerUnit, tt.perUnit)
+			}
+
+			if response := shouldRateLimit(t, client, req); response.OverallCode != tt.secondCall {
+				t.Errorf("second call: got %v, want %v", response.OverallCode, tt.secondCall)
+			}
+		})
+	}
+}
+
+func TestShouldRateLimitHitsAddend(t *testing.T) {
+	client := startServer(t, testDomains)
+
+	response := shouldRateLimit(t, client, &rlsv3.RateLimitRequest{
+		Domain:      "gateway",
+		Descriptors: []*commonv3.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+		HitsAddend:  2,
+	})
+	if response.OverallCode != rlsv3.RateLimitResponse_OK || response.Statuses[0].LimitRemaining != 1 {
+		t.Fatalf("got %v with %d remaining, want OK with 1", response.OverallCode, response.Statuses[0].LimitRemaining)
+	}
+
+	// a descriptor's own addend wins over the request's
+	perDescriptor := descriptor("remote_address", "10.0.0.1")
+	perDescriptor.HitsAddend = wrapperspb.UInt64(0)
+	response = shouldRateLimit(t, client, &rlsv3.RateLimitRequest{
+		Domain:      "gateway",
+		Descriptors: []*commonv3.RateLimitDescriptor{perDescriptor},
+		HitsAddend:  5,
+	})
+	if response.OverallCode != rlsv3.RateLimitResponse_OK || response.Statuses[0].LimitRemaining != 1 {
+		t.Fatalf("zero addend: got %v with %d remaining, want OK with 1", response.OverallCode, response.Statuses[0].LimitRemaining)
+	}
+
+	response = shouldRateLimit(t, client, &rlsv3.RateLimitRequest{
+		Domain:      "gateway",
+		Descriptors: []*commonv3.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+		HitsAddend:  2,
+	})
+	if response.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("got %v, want OVER_LIMIT once the addend exceeds what is left", response.OverallCode)
+	}
+}
+
+func TestShouldRateLimitHugeHitsAddend(t *testing.T) {
+	client := startServer(t, testDomains)
+
+	for _, addend := range []uint64{4, 1 << 63, math.MaxUint64} {
+		huge := descriptor("remote_address", "10.0.0.1")
+		huge.HitsAddend = wrapperspb.UInt64(addend)
+		response := shouldRateLimit(t, client, &rlsv3.RateLimitRequest{
+			Domain:      "gateway",
+			Descriptors: []*commonv3.RateLimitDescriptor{huge},
+		})
+		if response.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+			t.Errorf("addend %d: got %v, want OVER_LIMIT", addend, response.OverallCode)
+		}
+	}
+
+	// the refused addends were not counted
+	response := shouldRateLimit(t, client, &rlsv3.RateLimitRequest{
+		Domain:      "gateway",
+		Descriptors: []*commonv3.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+		HitsAddend:  3,
+	})
+	if response.OverallCode != rlsv3.RateLimitResponse_OK {
+		t.Errorf("got %v, want OK for an addend equal to the limit", response.OverallCode)
+	}
+}
+
+func TestShouldRateLimitHeaders(t *testing.T) {
+	client := startServer(t, testDomains)
+	req := &rlsv3.RateLimitRequest{Domain: "gateway", Descriptors: []*commonv3.RateLimitDescriptor{
+		descriptor("remote_address", "10.0.0.1"),
+		descriptor("path", "/login", "remote_address", "10.0.0.1"),
+	}}
+
+	// the tightest limit is the nested one, 1 per hour
+	got := headers(shouldRateLimit(t, client, req))
+	if got["X-RateLimit-Limit"] != "1" || got["X-RateLimit-Remaining"] != "0" {
+		t.Errorf("headers %v, want limit 1 and remaining 0", got)
+	}
+	if reset := got["X-RateLimit-Reset"]; reset == "" || reset == "0" {
+		t.Errorf("X-RateLimit-Reset %q, want the seconds until the window resets", reset)
+	}
+	if _, ok := got["Retry-After"]; ok {
+		t.Errorf("Retry-After set on an allowed request")
+	}
+
+	response := shouldRateLimit(t, client, req)
+	if response.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("got %v, want OVER_LIMIT", response.OverallCode)
+	}
+	got = headers(response)
+	if retryAfter := got["Retry-After"]; retryAfter != "3600" {
+		t.Errorf("Retry-After %q, want 3600", retryAfter)
+	}
+}
+
+func TestShouldRateLimitInvalidRequest(t *testing.T) {
+	client := startServer(t, testDomains)
+
+	requests := map[string]*rlsv3.RateLimitRequest{
+		"empty domain":      {Descriptors: []*commonv3.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")}},
+		"empty descriptors": {Domain: "gateway"},
+	}
+	for name, req := range requests {
+		if _, err := client.ShouldRateLimit(context.Background(), req); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
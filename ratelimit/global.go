@@ -0,0 +1,305 @@
+// Package ratelimit provides a global token bucket limiter, a per-client
+// sliding window limiter, the stores behind them and net/http middleware.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --------------Token Store Definitions --------------
+type TokenStore interface {
+	Debit(count int) bool
+	Len() int
+	Cap() int
+	AddTokens(count int)
+}
+
+type MemoryBucket struct {
+	count int
+	cap   int
+	mu    sync.RWMutex
+}
+
+func NewMemoryBucket(count int, cap int) (*MemoryBucket, error) {
+
+	if cap <= 0 {
+		return nil, errors.New("Capacity must be a non-zero positive integer.")
+	}
+
+	if count < 0 {
+		return nil, errors.New("count must be a non-negative integer if provided.")
+	}
+
+	if count > cap {
+		return nil, errors.New("count must be less than or equal to capacity if provided.")
+	}
+
+	bucket := MemoryBucket{count: count, cap: cap}
+	return &bucket, nil
+}
+
+func (b *MemoryBucket) AddTokens(count int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.count+count >= b.cap {
+		b.count = b.cap
+	} else {
+		b.count += count
+	}
+}
+
+func (b *MemoryBucket) Debit(count int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.count >= count {
+		b.count -= count
+		return true
+	}
+	return false
+}
+
+// SetTokens overwrites the token count, clamped to [0, cap].
+func (b *MemoryBucket) SetTokens(count int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.count = max(0, min(count, b.cap))
+}
+
+func (b *MemoryBucket) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.count
+}
+
+func (b *MemoryBucket) Cap() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cap
+}
+
+// AtomicBucket is a lock-free TokenStore: every update is a compare-and-swap
+// on the token count, so concurrent requests never queue behind a mutex.
+type AtomicBucket struct {
+	count atomic.Int64
+	cap   int64
+}
+
+func NewAtomicBucket(count int, cap int) (*AtomicBucket, error) {
+	// same bounds as the mutex based bucket
+	if _, err := NewMemoryBucket(count, cap); err != nil {
+		return nil, err
+	}
+
+	bucket := &AtomicBucket{cap: int64(cap)}
+	bucket.count.Store(int64(count))
+	return bucket, nil
+}
+
+func (b *AtomicBucket) AddTokens(count int) {
+	for {
+		current := b.count.Load()
+		next := min(current+int64(count), b.cap)
+		if next == current || b.count.CompareAndSwap(current, next) {
+			return
+		}
+	}
+}
+
+func (b *AtomicBucket) Debit(count int) bool {
+	for {
+		current := b.count.Load()
+		if current < int64(count) {
+			return false
+		}
+		if b.count.CompareAndSwap(current, current-int64(count)) {
+			return true
+		}
+	}
+}
+
+// SetTokens overwrites the token count, clamped to [0, cap].
+func (b *AtomicBucket) SetTokens(count int) {
+	b.count.Store(max(0, min(int64(count), b.cap)))
+}
+
+func (b *AtomicBucket) Len() int {
+	return int(b.count.Load())
+}
+
+func (b *AtomicBucket) Cap() int {
+	return int(b.cap)
+}
+
+// ----------------Limiter definition-----------
+
+// GlobalOptions configures a GlobalRateLimiter.
+type GlobalOptions struct {
+	Capacity      int        // tokens in a full bucket
+	InitialTokens int        // tokens available at start
+	RatePerMinute int        // tokens added back per minute
+	Store         TokenStore // defaults to a MemoryBucket sized from Capacity and InitialTokens
+}
+
+// GlobalRateLimiter is a token bucket shared by every request.
+type GlobalRateLimiter struct {
+	bucket TokenStore
+	rate   int          //token refill rate per minute
+	debt   atomic.Int64 // tokens promised to reservations, paid back by refills before the bucket
+	done   chan struct{}
+}
+
+func NewGlobalRateLimiter(opts GlobalOptions) (*GlobalRateLimiter, error) {
+	if opts.RatePerMinute <= 0 {
+		return nil, errors.New("Rate must be a non-zero positive integer.")
+	}
+
+	store := opts.Store
+	if store == nil {
+		bucket, err := NewMemoryBucket(opts.InitialTokens, opts.Capacity)
+		if err != nil {
+			return nil, err
+		}
+		store = bucket
+	}
+
+	limiter := &GlobalRateLimiter{bucket: store, rate: opts.RatePerMinute, done: make(chan struct{})}
+	go limiter.refill()
+	return limiter, nil
+}
+
+// Allow debits cost tokens, it reports false and debits nothing when fewer are
+// left. It returns ErrInvalidCost when cost is below 1.
+func (l *GlobalRateLimiter) Allow(cost int) (bool, error) {
+	if cost < 1 {
+		return false, ErrInvalidCost
+	}
+	return l.bucket.Debit(cost), nil
+}
+
+// Reserve takes cost tokens now if the bucket has them and no reservation is
+// waiting, otherwise it reserves them from future refills. Reservations are
+// served in order.
+func (l *GlobalRateLimiter) Reserve(cost int) (*Reservation, error) {
+	if cost < 1 {
+		return nil, ErrInvalidCost
+	}
+	if cost > l.bucket.Cap() {
+		return nil, ErrCostExceedsCapacity
+	}
+
+	now := time.Now()
+	if l.debt.Load() == 0 && l.bucket.Debit(cost) {
+		return &Reservation{at: now, cancel: func() { l.bucket.AddTokens(cost) }}, nil
+	}
+
+	debt := l.debt.Add(int64(cost))
+	return &Reservation{at: now.Add(time.Duration(debt) * l.interval()), cancel: func() { l.refund(cost) }}, nil
+}
+
+// Wait blocks until cost tokens are available or ctx ends.
+func (l *GlobalRateLimiter) Wait(ctx context.Context, cost int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	reservation, err := l.Reserve(cost)
+	if err != nil {
+		return err
+	}
+	return wait(ctx, reservation)
+}
+
+// RetryAfter estimates how long until cost tokens are free, counting the
+// tokens already promised to reservations.
+func (l *GlobalRateLimiter) RetryAfter(cost int) (time.Duration, error) {
+	if cost < 1 {
+		return 0, ErrInvalidCost
+	}
+	deficit := int64(cost-l.bucket.Len()) + l.debt.Load()
+	if deficit <= 0 {
+		return 0, nil
+	}
+	return time.Duration(deficit) * l.interval(), nil
+}
+
+// refund cancels cost tokens of debt, whatever refills already paid goes
+// back into the bucket.
+func (l *GlobalRateLimiter) refund(cost int) {
+	for {
+		debt := l.debt.Load()
+		forgiven := min(debt, int64(cost))
+		if l.debt.CompareAndSwap(debt, debt-forgiven) {
+			if paid := cost - int(forgiven); paid > 0 {
+				l.bucket.AddTokens(paid)
+			}
+			return
+		}
+	}
+}
+
+// Tokens is the number of tokens currently available.
+func (l *GlobalRateLimiter) Tokens() int {
+	return l.bucket.Len()
+}
+
+func (l *GlobalRateLimiter) Cap() int {
+	return l.bucket.Cap()
+}
+
+// Snapshot captures the bucket so it can be restored after a restart.
+func (l *GlobalRateLimiter) Snapshot() BucketSnapshot {
+	return BucketSnapshot{Tokens: l.bucket.Len(), Cap: l.bucket.Cap()}
+}
+
+// Restore sets the bucket to a snapshot taken at takenAt, plus the tokens that
+// would have been refilled since then.
+func (l *GlobalRateLimiter) Restore(snapshot BucketSnapshot, takenAt time.Time) error {
+	setter, ok := l.bucket.(TokenSetter)
+	if !ok {
+		return errors.New("Token store does not support snapshots.")
+	}
+
+	refilled := time.Since(takenAt).Minutes() * float64(l.rate)
+	setter.SetTokens(int(min(float64(snapshot.Tokens)+refilled, float64(l.bucket.Cap()))))
+	return nil
+}
+
+// Offline stops the refill goroutine.
+func (l *GlobalRateLimiter) Offline() {
+	close(l.done)
+}
+
+func (l *GlobalRateLimiter) interval() time.Duration {
+	return time.Minute / time.Duration(l.rate)
+}
+
+func (l *GlobalRateLimiter) refill() {
+	ticker := time.NewTicker(l.interval())
+	for {
+		select {
+		case <-ticker.C:
+			l.payDebtOrAddToken()
+		case <-l.done:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// payDebtOrAddToken hands a refilled token to the oldest reservation, or to
+// the bucket when none is waiting.
+func (l *GlobalRateLimiter) payDebtOrAddToken() {
+	for {
+		debt := l.debt.Load()
+		if debt == 0 {
+			l.bucket.AddTokens(1)
+			return
+		}
+		if l.debt.CompareAndSwap(debt, debt-1) {
+			return
+		}
+	}
+}
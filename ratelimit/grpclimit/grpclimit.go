@@ -0,0 +1,224 @@
+// Package grpclimit applies the ratelimit limiters to gRPC servers through
+// unary and stream interceptors.
+package grpclimit
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dessources/go_rate_limiter/ratelimit"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// KeyFunc identifies the client a call is counted against. It reports false
+// when the call can't be attributed to a client.
+type KeyFunc func(ctx context.Context) (string, bool)
+
+// PeerIP keys calls by the IP of the peer.
+func PeerIP(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "", false
+	}
+
+	addr := p.Addr.String()
+	if ip, _, err := net.SplitHostPort(addr); err == nil {
+		addr = ip
+	}
+	return addr, addr != ""
+}
+
+// PeerPrefix keys calls by the network of the peer's IP, like
+// ratelimit.ClientPrefix does for HTTP requests.
+func PeerPrefix(v4Bits, v6Bits int) KeyFunc {
+	return func(ctx context.Context) (string, bool) {
+		ip, ok := PeerIP(ctx)
+		return ratelimit.MaskIP(ip, v4Bits, v6Bits), ok
+	}
+}
+
+// MetadataKey keys calls by the first value of the incoming metadata key,
+// e.g. "x-api-key".
+func MetadataKey(key string) KeyFunc {
+	key = strings.ToLower(key)
+	return func(ctx context.Context) (string, bool) {
+		md, ok := metadata.FromIncomingContext(ctx)
+		if !ok {
+			return "", false
+		}
+		if values := md.Get(key); len(values) > 0 && values[0] != "" {
+			return values[0], true
+		}
+		return "", false
+	}
+}
+
+// MetadataOrPeer keys calls by the metadata key when present and by the peer
+// IP otherwise.
+func MetadataOrPeer(key string) KeyFunc {
+	fromMetadata := MetadataKey(key)
+	return func(ctx context.Context) (string, bool) {
+		if k, ok := fromMetadata(ctx); ok {
+			return k, true
+		}
+		return PeerIP(ctx)
+	}
+}
+
+type StreamMode int
+
+const (
+	// PerStream counts a stream once, when it is opened.
+	PerStream StreamMode = iota
+	// PerMessage counts every message the client sends on a stream.
+	PerMessage
+)
+
+// RejectFunc turns a rejection into the error returned to the client.
+type RejectFunc func(ctx context.Context, fullMethod string, rejection ratelimit.Rejection) error
+
+// DefaultReject answers with ResourceExhausted, or Unauthenticated when the
+// client key is missing, and attaches a RetryInfo when the wait is known.
+func DefaultReject(ctx context.Context, fullMethod string, rejection ratelimit.Rejection) error {
+	code, msg := codes.ResourceExhausted, "Rate limit exceeded. Please try again later"
+	switch rejection.Reason {
+	case ratelimit.ReasonMissingKey:
+		code, msg = codes.Unauthenticated, "Missing client key."
+	case ratelimit.ReasonGlobalLimit, ratelimit.ReasonStoreFull:
+		msg = "We are a bit busy right now. Please try again later."
+	}
+
+	st := status.New(code, msg)
+	if rejection.RetryAfter > 0 {
+		if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(rejection.RetryAfter)}); err == nil {
+			st = detailed
+		}
+	}
+	return st.Err()
+}
+
+type Options struct {
+	Global     *ratelimit.GlobalRateLimiter    // skipped when nil
+	PerClient  *ratelimit.PerClientRateLimiter // skipped when nil
+	Key        KeyFunc                         // defaults to PeerIP
+	StreamMode StreamMode                      // defaults to PerStream
+	Skip       func(fullMethod string) bool    // methods it returns true for are not limited
+	OnReject   RejectFunc                      // defaults to DefaultReject
+	// Shadow lets every call through, refusals are only reported to OnShadowReject.
+	Shadow         bool
+	OnShadowReject func(ctx context.Context, fullMethod string, rejection ratelimit.Rejection)
+}
+
+type interceptor struct {
+	Options
+}
+
+func newInterceptor(opts Options) *interceptor {
+	if opts.Key == nil {
+		opts.Key = PeerIP
+	}
+	if opts.OnReject == nil {
+		opts.OnReject = DefaultReject
+	}
+	return &interceptor{opts}
+}
+
+// limit counts one call or message against both limiters and returns the
+// error to answer with when either refuses it.
+func (i *interceptor) limit(ctx context.Context, fullMethod string) error {
+	if i.Skip != nil && i.Skip(fullMethod) {
+		return nil
+	}
+
+	if i.Global != nil {
+		if allowed, _ := i.Global.Allow(1); !allowed {
+			retryAfter, _ := i.Global.RetryAfter(1)
+			if err := i.reject(ctx, fullMethod, ratelimit.Rejection{Reason: ratelimit.ReasonGlobalLimit, RetryAfter: retryAfter}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if i.PerClient != nil {
+		key, ok := i.Key(ctx)
+		if !ok {
+			return i.reject(ctx, fullMethod, ratelimit.Rejection{Reason: ratelimit.ReasonMissingKey})
+		}
+		if err := i.PerClient.Allow(key); err != nil {
+			return i.reject(ctx, fullMethod, ratelimit.PerClientRejection(i.PerClient, key, 1, err))
+		}
+	}
+	return nil
+}
+
+// reject returns the error refusing the call, or nil in shadow mode.
+func (i *interceptor) reject(ctx context.Context, fullMethod string, rejection ratelimit.Rejection) error {
+	if !i.Shadow {
+		return i.OnReject(ctx, fullMethod, rejection)
+	}
+	if i.OnShadowReject != nil {
+		i.OnShadowReject(ctx, fullMethod, rejection)
+	}
+	return nil
+}
+
+// UnaryServerInterceptor limits every unary call.
+func UnaryServerInterceptor(opts Options) grpc.UnaryServerInterceptor {
+	i := newInterceptor(opts)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := i.limit(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor limits streams when they are opened, or every
+// message received on them with PerMessage.
+func StreamServerInterceptor(opts Options) grpc.StreamServerInterceptor {
+	i := newInterceptor(opts)
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if i.StreamMode == PerMessage {
+			return handler(srv, &limitedStream{ss, i, info.FullMethod})
+		}
+
+		if err := i.limit(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// limitedStream counts each received message, a refused message ends the
+// stream with the rejection error.
+type limitedStream struct {
+	grpc.ServerStream
+	interceptor *interceptor
+	fullMethod  string
+}
+
+func (s *limitedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.interceptor.limit(s.Context(), s.fullMethod)
+}
+
+// RetryDelay reads the RetryInfo attached to a rejection, for clients that
+// want to back off accordingly.
+func RetryDelay(err error) (time.Duration, bool) {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration(), true
+		}
+	}
+	return 0, false
+}
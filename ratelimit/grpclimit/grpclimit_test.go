@@ -0,0 +1,205 @@
+package grpclimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dessources/go_rate_limiter/ratelimit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// peerListener hands out in-memory connections whose remote address is the
+// one the client dialed from, so calls can come from any IP.
+type peerListener struct {
+	*bufconn.Listener
+	remotes chan net.Addr
+}
+
+type peerConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *peerConn) RemoteAddr() net.Addr { return c.remote }
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &peerConn{conn, <-l.remotes}, nil
+}
+
+// startServer serves the health and reflection services behind the
+// interceptors over an in-memory listener. The returned function connects a
+// client calling from ip.
+func startServer(t *testing.T, opts Options) func(ip string) *grpc.ClientConn {
+	t.Helper()
+	listener := &peerListener{bufconn.Listen(1 << 20), make(chan net.Addr, 1)}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(opts)),
+		grpc.StreamInterceptor(StreamServerInterceptor(opts)),
+	)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	reflection.Register(server)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	return func(ip string) *grpc.ClientConn {
+		conn, err := grpc.NewClient("passthrough:///bufconn",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				listener.remotes <- &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}
+				return listener.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+}
+
+func newPerClient(t *testing.T, limit int) *ratelimit.PerClientRateLimiter {
+	t.Helper()
+	limiter, err := ratelimit.NewPerClientRateLimiter(ratelimit.PerClientOptions{Limit: limit, Window: time.Minute, Capacity: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(limiter.Offline)
+	return limiter
+}
+
+func check(conn *grpc.ClientConn, md ...string) error {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), md...)
+	_, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+// wantExhausted checks that err is a ResourceExhausted status carrying a
+// positive retry delay no longer than within.
+func wantExhausted(t *testing.T, err error, within time.Duration) {
+	t.Helper()
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Fatalf("got %v (%v), want ResourceExhausted", code, err)
+	}
+	delay, ok := RetryDelay(err)
+	if !ok || delay <= 0 || delay > within {
+		t.Errorf("retry delay %v (attached: %v), want one within %v", delay, ok, within)
+	}
+}
+
+func TestUnaryPerClientByPeerPrefix(t *testing.T) {
+	dial := startServer(t, Options{PerClient: newPerClient(t, 1), Key: PeerPrefix(24, 64)})
+
+	if err := check(dial("10.0.0.1")); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	// same /24, same client
+	wantExhausted(t, check(dial("10.0.0.2")), time.Minute)
+	if err := check(dial("10.0.1.1")); err != nil {
+		t.Errorf("call from another network: %v", err)
+	}
+}
+
+func TestUnaryGlobal(t *testing.T) {
+	global, err := ratelimit.NewGlobalRateLimiter(ratelimit.GlobalOptions{Capacity: 1, InitialTokens: 1, RatePerMinute: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(global.Offline)
+	conn := startServer(t, Options{Global: global})("10.0.0.1")
+
+	if err := check(conn); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	wantExhausted(t, check(conn), time.Minute)
+}
+
+func TestUnaryMissingKey(t *testing.T) {
+	conn := startServer(t, Options{PerClient: newPerClient(t, 1), Key: MetadataKey("X-API-Key")})("10.0.0.1")
+
+	if code := status.Code(check(conn)); code != codes.Unauthenticated {
+		t.Errorf("without a key: got %v, want Unauthenticated", code)
+	}
+	if err := check(conn, "x-api-key", "partner-a"); err != nil {
+		t.Errorf("with a key: %v", err)
+	}
+}
+
+func TestUnaryShadow(t *testing.T) {
+	var rejections []ratelimit.Rejection
+	conn := startServer(t, Options{
+		PerClient: newPerClient(t, 1),
+		Shadow:    true,
+		OnShadowReject: func(_ context.Context, _ string, rejection ratelimit.Rejection) {
+			rejections = append(rejections, rejection)
+		},
+	})("10.0.0.1")
+
+	for i := range 3 {
+		if err := check(conn); err != nil {
+			t.Fatalf("call %d: %v", i+1, err)
+		}
+	}
+	if len(rejections) != 2 || rejections[0].Reason != ratelimit.ReasonClientLimit || rejections[0].Key != "10.0.0.1" {
+		t.Errorf("shadow rejections %+v, want 2 client_limit ones for 10.0.0.1", rejections)
+	}
+}
+
+func listServices(stream reflectionpb.ServerReflection_ServerReflectionInfoClient) error {
+	req := &reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{}}
+	if err := stream.Send(req); err != nil {
+		return err
+	}
+	_, err := stream.Recv()
+	return err
+}
+
+func openStream(t *testing.T, client reflectionpb.ServerReflectionClient) reflectionpb.ServerReflection_ServerReflectionInfoClient {
+	t.Helper()
+	stream, err := client.ServerReflectionInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+func TestStreamPerStream(t *testing.T) {
+	client := reflectionpb.NewServerReflectionClient(startServer(t, Options{PerClient: newPerClient(t, 2)})("10.0.0.1"))
+
+	// a stream counts once however many messages it carries
+	for i := range 2 {
+		stream := openStream(t, client)
+		for j := range 3 {
+			if err := listServices(stream); err != nil {
+				t.Fatalf("stream %d, message %d: %v", i+1, j+1, err)
+			}
+		}
+	}
+	wantExhausted(t, listServices(openStream(t, client)), time.Minute)
+}
+
+func TestStreamPerMessage(t *testing.T) {
+	client := reflectionpb.NewServerReflectionClient(startServer(t, Options{PerClient: newPerClient(t, 2), StreamMode: PerMessage})("10.0.0.1"))
+
+	stream := openStream(t, client)
+	for i := range 2 {
+		if err := listServices(stream); err != nil {
+			t.Fatalf("message %d: %v", i+1, err)
+		}
+	}
+	wantExhausted(t, listServices(stream), time.Minute)
+}
@@ -0,0 +1,236 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// KeyFunc identifies the client a request is counted against. It reports
+// false when the request can't be attributed to a client.
+type KeyFunc func(r *http.Request) (string, bool)
+
+// ClientIP keys requests by the IP in r.RemoteAddr.
+func ClientIP(r *http.Request) (string, bool) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return ip, ip != ""
+}
+
+// ClientPrefix keys requests by the network of the IP in r.RemoteAddr, e.g.
+// ClientPrefix(32, 64) counts every address of an IPv6 /64 as one client,
+// since rotating through them is trivial.
+func ClientPrefix(v4Bits, v6Bits int) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		ip, ok := ClientIP(r)
+		return MaskIP(ip, v4Bits, v6Bits), ok
+	}
+}
+
+// MaskIP returns the network of ip in CIDR notation, keeping v4Bits of an
+// IPv4 address and v6Bits of an IPv6 one. An address kept whole is returned
+// bare, and anything that isn't an IP is returned unchanged.
+func MaskIP(ip string, v4Bits, v6Bits int) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap().WithZone("")
+
+	bits := v6Bits
+	if addr.Is4() {
+		bits = v4Bits
+	}
+	if bits >= addr.BitLen() {
+		return addr.String()
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// HeaderKey keys requests by the value of header, e.g. an API key.
+func HeaderKey(header string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		key := r.Header.Get(header)
+		return key, key != ""
+	}
+}
+
+type RejectReason string
+
+const (
+	ReasonGlobalLimit RejectReason = "global_limit"
+	ReasonClientLimit RejectReason = "client_limit"
+	ReasonStoreFull   RejectReason = "store_full"
+	ReasonMissingKey  RejectReason = "missing_key"
+)
+
+// Rejection describes why a request was refused.
+type Rejection struct {
+	Reason     RejectReason
+	Key        string        // empty for global and missing key rejections
+	Err        error         // the limiter error behind a per-client rejection
+	RetryAfter time.Duration // estimated wait before a retry can succeed, zero when unknown
+}
+
+// Status is the HTTP status a rejection is answered with by default.
+func (r Rejection) Status() int {
+	if r.Reason == ReasonMissingKey {
+		return http.StatusUnauthorized
+	}
+	return http.StatusTooManyRequests
+}
+
+// RejectHandler writes the response to a refused request.
+type RejectHandler func(w http.ResponseWriter, r *http.Request, rejection Rejection)
+
+var rejectMessages = map[RejectReason]string{
+	ReasonGlobalLimit: "We are a bit busy right now. Please try again later.",
+	ReasonClientLimit: "Rate limit exceeded. Please try again later",
+	ReasonStoreFull:   "We are a bit busy right now. Please try again later.",
+	ReasonMissingKey:  "Invalid API key provided.",
+}
+
+// DefaultRejectHandler answers with the rejection's status, a Retry-After
+// header when the wait is known and a JSON body of the form {"errorMessage": "..."}.
+func DefaultRejectHandler(w http.ResponseWriter, r *http.Request, rejection Rejection) {
+	if rejection.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rejection.RetryAfter.Seconds()))))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(rejection.Status())
+	json.NewEncoder(w).Encode(struct {
+		Msg string `json:"errorMessage"`
+	}{rejectMessages[rejection.Reason]})
+}
+
+// ShadowHandler is told about a request a shadow limiter would have refused.
+type ShadowHandler func(r *http.Request, rejection Rejection)
+
+type GlobalMiddlewareOptions struct {
+	Cost       int                                 // tokens debited per request, defaults to 1
+	Skip       func(r *http.Request) bool          // requests it returns true for are not limited
+	OnReject   RejectHandler                       // defaults to DefaultRejectHandler
+	OnDecision func(r *http.Request, allowed bool) // called for every request, e.g. to record metrics
+	// Shadow lets every request through, refusals are only reported to
+	// OnShadowReject. Useful to try a limit out before enforcing it.
+	Shadow         bool
+	OnShadowReject ShadowHandler
+}
+
+// GlobalMiddleware debits l for every request and refuses those arriving
+// while the bucket is empty.
+func GlobalMiddleware(l *GlobalRateLimiter, opts GlobalMiddlewareOptions) func(http.Handler) http.Handler {
+	cost := max(opts.Cost, 1)
+	onReject := opts.OnReject
+	if onReject == nil {
+		onReject = DefaultRejectHandler
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if opts.Skip != nil && opts.Skip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// cost is at least 1 so neither call can fail
+			allowed, _ := l.Allow(cost)
+			if opts.OnDecision != nil {
+				opts.OnDecision(r, allowed)
+			}
+			if !allowed {
+				retryAfter, _ := l.RetryAfter(cost)
+				rejection := Rejection{Reason: ReasonGlobalLimit, RetryAfter: retryAfter}
+				if !opts.Shadow {
+					onReject(w, r, rejection)
+					return
+				}
+				if opts.OnShadowReject != nil {
+					opts.OnShadowReject(r, rejection)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type PerClientMiddlewareOptions struct {
+	Key        KeyFunc                                         // defaults to ClientIP
+	Skip       func(r *http.Request) bool                      // requests it returns true for are not limited
+	OnReject   RejectHandler                                   // defaults to DefaultRejectHandler
+	OnDecision func(r *http.Request, key string, allowed bool) // called for every limited request
+	// Shadow lets every request through, including those without a key,
+	// refusals are only reported to OnShadowReject.
+	Shadow         bool
+	OnShadowReject ShadowHandler
+}
+
+// PerClientMiddleware counts every request against the window of the client
+// returned by opts.Key.
+func PerClientMiddleware(l *PerClientRateLimiter, opts PerClientMiddlewareOptions) func(http.Handler) http.Handler {
+	keyFunc := opts.Key
+	if keyFunc == nil {
+		keyFunc = ClientIP
+	}
+	onReject := opts.OnReject
+	if onReject == nil {
+		onReject = DefaultRejectHandler
+	}
+
+	reject := func(w http.ResponseWriter, r *http.Request, rejection Rejection) bool {
+		if !opts.Shadow {
+			onReject(w, r, rejection)
+			return true
+		}
+		if opts.OnShadowReject != nil {
+			opts.OnShadowReject(r, rejection)
+		}
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if opts.Skip != nil && opts.Skip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key, ok := keyFunc(r)
+			if !ok {
+				if !reject(w, r, Rejection{Reason: ReasonMissingKey}) {
+					next.ServeHTTP(w, r)
+				}
+				return
+			}
+
+			err := l.Allow(key)
+			if opts.OnDecision != nil {
+				opts.OnDecision(r, key, err == nil)
+			}
+			if err != nil && reject(w, r, PerClientRejection(l, key, 1, err)) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// PerClientRejection describes the refusal of n requests by key, err being
+// what l returned.
+func PerClientRejection(l *PerClientRateLimiter, key string, n int, err error) Rejection {
+	if errors.Is(err, ErrStoreFull) {
+		return Rejection{ReasonStoreFull, key, err, 0}
+	}
+	return Rejection{ReasonClientLimit, key, err, l.RetryAfter(key, n)}
+}
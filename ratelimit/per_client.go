@@ -0,0 +1,608 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dessources/go_rate_limiter/internal/expiry"
+	"github.com/dessources/go_rate_limiter/internal/shard"
+)
+
+var (
+	ErrCostExceedsLimit = errors.New("Request cost exceeds the rate limit.")
+	ErrStoreFull        = errors.New("Storage is at capacity.")
+	ErrRateLimited      = errors.New("Rate limit exceeded. Please try again later")
+	ErrInvalidCost      = errors.New("Request cost must be a non-zero positive integer.")
+)
+
+// TimeLogStore keeps the request times of every client. Add returns
+// ErrRateLimited, ErrStoreFull or ErrCostExceedsLimit when the requests are refused.
+type TimeLogStore interface {
+	Add(k string, w time.Duration, n int) error
+	RemoveClient(k string) error
+	RemoveInactiveClients(ttl time.Duration) error
+	Cap() int
+	Len() int
+	Limit() int // requests allowed per client per window
+}
+
+// TimeLogReserver is implemented by time log stores that can hold slots of
+// a client's window for a later time.
+type TimeLogReserver interface {
+	// Reserve adds n requests for k at the earliest time they fit in window w.
+	Reserve(k string, w time.Duration, n int) (time.Time, error)
+	// Unreserve removes up to n requests that Reserve added for k at time at.
+	Unreserve(k string, at time.Time, n int)
+}
+
+// TimeLogReader is implemented by time log stores that can report a client's
+// requests without recording new ones.
+type TimeLogReader interface {
+	// Logs returns the times of k's requests within window w, oldest first.
+	Logs(k string, w time.Duration) []time.Time
+}
+
+type InMemoryTimeLogStore struct {
+	cap      int
+	len      int
+	slots    *shard.Slots // shared with the other shards of a ShardedTimeLogStore
+	limit    int
+	logs     map[string][]time.Time
+	lastSeen *expiry.Queue // clients ordered by their latest request
+	mu       sync.RWMutex
+}
+
+// Add records n requests for client k within window w.
+func (s *InMemoryTimeLogStore) Add(k string, w time.Duration, n int) error {
+	if n > s.limit {
+		return ErrCostExceedsLimit
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.logs[k]; exists {
+		// if existing client, remove old logs outside window
+		s.removeOldLogs(k, w)
+
+	} else {
+		//if new client, check global capacity
+		if !s.acquireSlot() {
+			return ErrStoreFull
+		}
+		s.logs[k] = make([]time.Time, 0, s.limit)
+		s.lastSeen.Set(k, time.Now())
+		s.len++
+	}
+
+	if len(s.logs[k])+n > s.limit {
+		// check rate limit
+		return ErrRateLimited
+	}
+
+	//add log entries, after any reservation already logged in the future
+	at := time.Now()
+	if last := len(s.logs[k]) - 1; last >= 0 && s.logs[k][last].After(at) {
+		at = s.logs[k][last]
+	}
+	for range n {
+		s.logs[k] = append(s.logs[k], at)
+	}
+	s.lastSeen.Set(k, at)
+	return nil
+}
+
+// Reserve is Add for callers willing to wait: when the window is full the
+// requests are logged at the time enough older ones will have left it.
+func (s *InMemoryTimeLogStore) Reserve(k string, w time.Duration, n int) (time.Time, error) {
+	if n > s.limit {
+		return time.Time{}, ErrCostExceedsLimit
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.logs[k]; exists {
+		s.removeOldLogs(k, w)
+	} else {
+		if !s.acquireSlot() {
+			return time.Time{}, ErrStoreFull
+		}
+		s.logs[k] = make([]time.Time, 0, s.limit)
+		s.len++
+	}
+
+	// the oldest len+n-limit requests have to leave the window first,
+	// logs may already hold reservations in the future so keep them ordered
+	at := time.Now()
+	logs := s.logs[k]
+	if over := len(logs) + n - s.limit; over > 0 {
+		at = logs[over-1].Add(w)
+	}
+	if last := len(logs) - 1; last >= 0 && logs[last].After(at) {
+		at = logs[last]
+	}
+
+	for range n {
+		s.logs[k] = append(s.logs[k], at)
+	}
+	s.lastSeen.Set(k, at)
+	return at, nil
+}
+
+func (s *InMemoryTimeLogStore) Unreserve(k string, at time.Time, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	logs := s.logs[k]
+	for i := len(logs) - 1; i >= 0 && n > 0; i-- {
+		if logs[i].Equal(at) {
+			logs = append(logs[:i], logs[i+1:]...)
+			n--
+		}
+	}
+	if _, exists := s.logs[k]; exists {
+		s.logs[k] = logs
+	}
+}
+
+func (s *InMemoryTimeLogStore) Logs(k string, w time.Duration) []time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	logs := s.logs[k]
+	first := len(logs)
+	for first > 0 && time.Since(logs[first-1]) < w {
+		first--
+	}
+	return append([]time.Time(nil), logs[first:]...)
+}
+
+// removeOldLogs assumes caller holds s.mu.Lock()
+func (s *InMemoryTimeLogStore) removeOldLogs(k string, w time.Duration) {
+
+	if lastLogIndex := len(s.logs[k]) - 1; lastLogIndex >= 0 {
+		lastLog := s.logs[k][lastLogIndex]
+		if time.Since(lastLog) >= w {
+			// All logs are old, reset the slice
+			s.logs[k] = s.logs[k][:0]
+		} else {
+			//find first log within window and resize slice
+			for i, logTime := range s.logs[k] {
+				if time.Since(logTime) < w {
+					s.logs[k] = s.logs[k][i:]
+					break
+				}
+			}
+		}
+	}
+}
+
+func (s *InMemoryTimeLogStore) RemoveClient(k string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.logs[k]; !exists {
+		return errors.New("Entry not found")
+	}
+	delete(s.logs, k)
+	s.lastSeen.Remove(k)
+	s.len--
+	s.releaseSlots(1)
+	return nil
+}
+
+// RemoveInactiveClients drops clients idle for longer than ttl. Clients come
+// off the lastSeen queue in batches so the lock is only held briefly.
+func (s *InMemoryTimeLogStore) RemoveInactiveClients(ttl time.Duration) error {
+	cutoff := time.Now().Add(-ttl)
+	for {
+		s.mu.Lock()
+		inactive := s.lastSeen.PopBefore(cutoff, expiry.BatchSize)
+		for _, key := range inactive {
+			delete(s.logs, key)
+			s.len--
+		}
+		s.releaseSlots(len(inactive))
+		s.mu.Unlock()
+
+		if len(inactive) < expiry.BatchSize {
+			return nil
+		}
+	}
+}
+
+// acquireSlot reports whether there is room for one more client.
+// Assumes caller holds s.mu.Lock()
+func (s *InMemoryTimeLogStore) acquireSlot() bool {
+	if s.slots != nil {
+		return s.slots.Acquire()
+	}
+	return s.len < s.cap
+}
+
+func (s *InMemoryTimeLogStore) releaseSlots(n int) {
+	if s.slots != nil {
+		s.slots.Release(n)
+	}
+}
+
+// SnapshotLogs copies every client's request times.
+func (s *InMemoryTimeLogStore) SnapshotLogs() map[string][]time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	logs := make(map[string][]time.Time, len(s.logs))
+	for k, times := range s.logs {
+		if len(times) > 0 {
+			logs[k] = append([]time.Time(nil), times...)
+		}
+	}
+	return logs
+}
+
+// RestoreLogs loads request times from a snapshot. Times outside window are
+// dropped, and so are clients left without any or that don't fit in cap.
+func (s *InMemoryTimeLogStore) RestoreLogs(logs map[string][]time.Time, w time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := time.Now().Add(-w)
+
+	for k, times := range logs {
+		if _, exists := s.logs[k]; exists {
+			continue
+		}
+
+		first := len(times)
+		for first > 0 && times[first-1].After(cutoff) {
+			first--
+		}
+		recent := times[max(first, len(times)-s.limit):]
+		if len(recent) == 0 || !s.acquireSlot() {
+			continue
+		}
+
+		s.logs[k] = append(make([]time.Time, 0, s.limit), recent...)
+		s.lastSeen.Set(k, recent[len(recent)-1])
+		s.len++
+	}
+}
+
+func (s *InMemoryTimeLogStore) Cap() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cap
+}
+
+func (s *InMemoryTimeLogStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.len
+}
+
+func (s *InMemoryTimeLogStore) Limit() int {
+	return s.limit
+}
+
+// NewInMemoryTimeLogStore tracks up to cap clients, each allowed limit requests per window.
+func NewInMemoryTimeLogStore(cap, limit int) *InMemoryTimeLogStore {
+	return &InMemoryTimeLogStore{cap: cap, logs: make(map[string][]time.Time), limit: limit, lastSeen: expiry.New()}
+}
+
+// ShardedTimeLogStore spreads clients across independently locked
+// InMemoryTimeLogStores so requests from different clients rarely contend.
+// The shards share one capacity.
+type ShardedTimeLogStore struct {
+	shards []*InMemoryTimeLogStore
+	slots  *shard.Slots
+}
+
+func NewShardedTimeLogStore(shards, cap, limit int) *ShardedTimeLogStore {
+	store := &ShardedTimeLogStore{shards: make([]*InMemoryTimeLogStore, shards), slots: shard.NewSlots(cap)}
+	for i := range store.shards {
+		store.shards[i] = NewInMemoryTimeLogStore(cap, limit)
+		store.shards[i].slots = store.slots
+	}
+	return store
+}
+
+func (s *ShardedTimeLogStore) shardOf(k string) *InMemoryTimeLogStore {
+	return s.shards[shard.Index(k, len(s.shards))]
+}
+
+func (s *ShardedTimeLogStore) Add(k string, w time.Duration, n int) error {
+	return s.shardOf(k).Add(k, w, n)
+}
+
+func (s *ShardedTimeLogStore) Reserve(k string, w time.Duration, n int) (time.Time, error) {
+	return s.shardOf(k).Reserve(k, w, n)
+}
+
+func (s *ShardedTimeLogStore) Unreserve(k string, at time.Time, n int) {
+	s.shardOf(k).Unreserve(k, at, n)
+}
+
+func (s *ShardedTimeLogStore) Logs(k string, w time.Duration) []time.Time {
+	return s.shardOf(k).Logs(k, w)
+}
+
+func (s *ShardedTimeLogStore) RemoveClient(k string) error {
+	return s.shardOf(k).RemoveClient(k)
+}
+
+func (s *ShardedTimeLogStore) RemoveInactiveClients(ttl time.Duration) error {
+	for _, store := range s.shards {
+		store.RemoveInactiveClients(ttl)
+	}
+	return nil
+}
+
+func (s *ShardedTimeLogStore) SnapshotLogs() map[string][]time.Time {
+	logs := make(map[string][]time.Time)
+	for _, store := range s.shards {
+		for k, times := range store.SnapshotLogs() {
+			logs[k] = times
+		}
+	}
+	return logs
+}
+
+func (s *ShardedTimeLogStore) RestoreLogs(logs map[string][]time.Time, w time.Duration) {
+	perShard := make([]map[string][]time.Time, len(s.shards))
+	for k, times := range logs {
+		i := shard.Index(k, len(s.shards))
+		if perShard[i] == nil {
+			perShard[i] = make(map[string][]time.Time)
+		}
+		perShard[i][k] = times
+	}
+
+	for i, store := range s.shards {
+		store.RestoreLogs(perShard[i], w)
+	}
+}
+
+func (s *ShardedTimeLogStore) Cap() int {
+	return s.slots.Cap()
+}
+
+func (s *ShardedTimeLogStore) Len() int {
+	return s.slots.Len()
+}
+
+func (s *ShardedTimeLogStore) Limit() int {
+	return s.shards[0].Limit()
+}
+
+// ----------------Limiter definition-----------
+
+// PerClientOptions configures a PerClientRateLimiter.
+type PerClientOptions struct {
+	Limit     int           // requests allowed per client per window, must match the Store's Limit()
+	Window    time.Duration // length of the sliding window
+	ClientTTL time.Duration // idle time before a client is forgotten, defaults to Window
+	Capacity  int           // max number of tracked clients
+	Store     TimeLogStore  // defaults to an InMemoryTimeLogStore sized from Capacity and Limit
+}
+
+// PerClientRateLimiter is a sliding window log per client key.
+type PerClientRateLimiter struct {
+	timeLogStore TimeLogStore
+	limit        int
+	window       time.Duration
+	clientTtl    time.Duration
+	done         chan struct{}
+}
+
+func NewPerClientRateLimiter(opts PerClientOptions) (*PerClientRateLimiter, error) {
+	if opts.Window <= 0 {
+		return nil, errors.New("Window must be a positive duration.")
+	}
+	if opts.Limit <= 0 {
+		return nil, errors.New("Limit must be a non-zero positive integer.")
+	}
+
+	store := opts.Store
+	if store == nil {
+		if opts.Capacity <= 0 {
+			return nil, errors.New("Capacity must be a non-zero positive integer.")
+		}
+		store = NewInMemoryTimeLogStore(opts.Capacity, opts.Limit)
+	} else if store.Limit() != opts.Limit {
+		return nil, fmt.Errorf("Limit %d does not match the store's limit of %d.", opts.Limit, store.Limit())
+	}
+
+	ttl := opts.ClientTTL
+	if ttl <= 0 {
+		ttl = opts.Window
+	}
+
+	limiter := &PerClientRateLimiter{store, opts.Limit, opts.Window, ttl, make(chan struct{})}
+	go limiter.removeInactiveClients()
+	return limiter, nil
+}
+
+func (l *PerClientRateLimiter) Allow(key string) error {
+	return l.AllowN(key, 1)
+}
+
+// AllowN counts n requests against the client's window at once.
+func (l *PerClientRateLimiter) AllowN(key string, n int) error {
+	if n < 1 {
+		return ErrInvalidCost
+	}
+	return l.timeLogStore.Add(key, l.window, n)
+}
+
+// Reserve takes n slots of the client's window, now if they are free or
+// otherwise as soon as enough earlier requests leave the window.
+func (l *PerClientRateLimiter) Reserve(key string, n int) (*Reservation, error) {
+	if n < 1 {
+		return nil, ErrInvalidCost
+	}
+	reserver, ok := l.timeLogStore.(TimeLogReserver)
+	if !ok {
+		return nil, errors.New("Time log store does not support reservations.")
+	}
+
+	at, err := reserver.Reserve(key, l.window, n)
+	if err != nil {
+		return nil, err
+	}
+	return &Reservation{at: at, cancel: func() { reserver.Unreserve(key, at, n) }}, nil
+}
+
+// Wait blocks until n requests of the client fit in its window or ctx ends.
+func (l *PerClientRateLimiter) Wait(ctx context.Context, key string, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	reservation, err := l.Reserve(key, n)
+	if err != nil {
+		return err
+	}
+	return wait(ctx, reservation)
+}
+
+// RetryAfter estimates how long until n more requests of the client fit in
+// its window. It is zero when they already do, or when the store can't tell.
+func (l *PerClientRateLimiter) RetryAfter(key string, n int) time.Duration {
+	reader, ok := l.timeLogStore.(TimeLogReader)
+	if !ok || n > l.limit {
+		return 0
+	}
+
+	logs := reader.Logs(key, l.window)
+	over := len(logs) + n - l.limit
+	if over <= 0 {
+		return 0
+	}
+	return max(time.Until(logs[over-1].Add(l.window)), 0)
+}
+
+// Remaining reports how many requests the client may still make and when
+// the oldest one counted leaves the window, freeing a slot. It returns the
+// full limit and now for unknown clients, or when the store can't tell.
+func (l *PerClientRateLimiter) Remaining(key string) (int, time.Time) {
+	reader, ok := l.timeLogStore.(TimeLogReader)
+	if !ok {
+		return l.limit, time.Now()
+	}
+
+	logs := reader.Logs(key, l.window)
+	if len(logs) == 0 {
+		return l.limit, time.Now()
+	}
+	return max(l.limit-len(logs), 0), logs[0].Add(l.window)
+}
+
+// Decision is the outcome of a Check or Consume.
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int           // requests left once the decision is applied
+	ResetAt    time.Time     // when the oldest counted request leaves the window
+	RetryAfter time.Duration // zero when allowed
+}
+
+// Check reports what Consume would decide for n requests of key, without
+// recording anything.
+func (l *PerClientRateLimiter) Check(key string, n int) (Decision, error) {
+	if _, ok := l.timeLogStore.(TimeLogReader); !ok {
+		return Decision{}, errors.New("Time log store does not support checks.")
+	}
+	if n < 1 {
+		return Decision{}, ErrInvalidCost
+	}
+	if n > l.limit {
+		return Decision{}, ErrCostExceedsLimit
+	}
+
+	remaining, resetAt := l.Remaining(key)
+	decision := Decision{Allowed: n <= remaining, Limit: l.limit, Remaining: remaining, ResetAt: resetAt}
+	if decision.Allowed {
+		decision.Remaining -= n
+		if remaining == l.limit {
+			// the requests would start a new window
+			decision.ResetAt = time.Now().Add(l.window)
+		}
+	} else {
+		decision.RetryAfter = l.RetryAfter(key, n)
+	}
+	return decision, nil
+}
+
+// Consume records n requests of key when they fit in its window. Being over
+// the limit is reported in the decision, other refusals such as ErrStoreFull
+// or ErrCostExceedsLimit are returned as errors.
+func (l *PerClientRateLimiter) Consume(key string, n int) (Decision, error) {
+	err := l.AllowN(key, n)
+	if err != nil && !errors.Is(err, ErrRateLimited) {
+		return Decision{}, err
+	}
+
+	remaining, resetAt := l.Remaining(key)
+	decision := Decision{Allowed: err == nil, Limit: l.limit, Remaining: remaining, ResetAt: resetAt}
+	if !decision.Allowed {
+		decision.RetryAfter = l.RetryAfter(key, n)
+	}
+	return decision, nil
+}
+
+func (l *PerClientRateLimiter) Limit() int {
+	return l.limit
+}
+
+// Len is the number of clients currently tracked.
+func (l *PerClientRateLimiter) Len() int {
+	return l.timeLogStore.Len()
+}
+
+func (l *PerClientRateLimiter) Cap() int {
+	return l.timeLogStore.Cap()
+}
+
+func (l *PerClientRateLimiter) Window() time.Duration {
+	return l.window
+}
+
+// Snapshot captures every client's request times so they survive a restart.
+func (l *PerClientRateLimiter) Snapshot() (map[string][]time.Time, error) {
+	snapshotter, ok := l.timeLogStore.(TimeLogSnapshotter)
+	if !ok {
+		return nil, errors.New("Time log store does not support snapshots.")
+	}
+	return snapshotter.SnapshotLogs(), nil
+}
+
+// Restore loads request times from a snapshot, discarding those already
+// outside the limiter's window.
+func (l *PerClientRateLimiter) Restore(logs map[string][]time.Time) error {
+	snapshotter, ok := l.timeLogStore.(TimeLogSnapshotter)
+	if !ok {
+		return errors.New("Time log store does not support snapshots.")
+	}
+	snapshotter.RestoreLogs(logs, l.window)
+	return nil
+}
+
+// Offline stops the inactive client cleanup goroutine.
+func (l *PerClientRateLimiter) Offline() {
+	close(l.done)
+}
+
+func (l *PerClientRateLimiter) removeInactiveClients() {
+	ticker := time.NewTicker(min(l.clientTtl/2, expiry.SweepInterval))
+	for {
+		select {
+		case <-ticker.C:
+			l.timeLogStore.RemoveInactiveClients(l.clientTtl)
+
+		case <-l.done:
+			ticker.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package ratelimit
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dessources/go_rate_limiter/internal/shard"
+)
+
+// TestReserveThenAdd mixes reservations and plain requests on one key: a
+// request allowed while a reservation is pending must not let the window
+// forget that reservation once the request itself leaves it.
+func TestReserveThenAdd(t *testing.T) {
+	const window = 200 * time.Millisecond
+	stores := map[string]func() TimeLogStore{
+		"inMemory": func() TimeLogStore { return NewInMemoryTimeLogStore(10, 2) },
+		"sharded":  func() TimeLogStore { return NewShardedTimeLogStore(4, 10, 2) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			limiter, err := NewPerClientRateLimiter(PerClientOptions{Limit: 2, Window: window, Store: newStore()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer limiter.Offline()
+
+			if err := limiter.AllowN("k", 2); err != nil {
+				t.Fatalf("AllowN: %v", err)
+			}
+			first, err := limiter.Reserve("k", 2)
+			if err != nil {
+				t.Fatalf("Reserve: %v", err)
+			}
+			second, err := limiter.Reserve("k", 1)
+			if err != nil {
+				t.Fatalf("Reserve: %v", err)
+			}
+			first.Cancel()
+
+			// only the second reservation is left in the window
+			time.Sleep(time.Until(first.At().Add(window / 10)))
+			if err := limiter.Allow("k"); err != nil {
+				t.Fatalf("Allow next to one reservation: %v", err)
+			}
+
+			// that request is logged no earlier than the reservation, so
+			// both still fill the window
+			time.Sleep(time.Until(first.At().Add(window + window/5)))
+			if time.Since(second.At()) >= window {
+				t.Fatalf("reservation already out of the window, the test ran too slowly")
+			}
+			if err := limiter.Allow("k"); !errors.Is(err, ErrRateLimited) {
+				t.Errorf("Allow with the window full: got %v, want ErrRateLimited", err)
+			}
+			if logs := limiter.timeLogStore.(TimeLogReader).Logs("k", window); !slices.IsSortedFunc(logs, time.Time.Compare) {
+				t.Errorf("logs out of order: %v", logs)
+			}
+		})
+	}
+}
+
+func TestInvalidCost(t *testing.T) {
+	perClient, err := NewPerClientRateLimiter(PerClientOptions{Limit: 2, Window: time.Minute, Capacity: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer perClient.Offline()
+	global, err := NewGlobalRateLimiter(GlobalOptions{Capacity: 2, InitialTokens: 2, RatePerMinute: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer global.Offline()
+
+	for _, cost := range []int{0, -5} {
+		if err := perClient.AllowN("k", cost); !errors.Is(err, ErrInvalidCost) {
+			t.Errorf("per-client AllowN(%d): got %v, want ErrInvalidCost", cost, err)
+		}
+		if _, err := perClient.Reserve("k", cost); !errors.Is(err, ErrInvalidCost) {
+			t.Errorf("per-client Reserve(%d): got %v, want ErrInvalidCost", cost, err)
+		}
+		if _, err := global.Allow(cost); !errors.Is(err, ErrInvalidCost) {
+			t.Errorf("global Allow(%d): got %v, want ErrInvalidCost", cost, err)
+		}
+		if _, err := global.Reserve(cost); !errors.Is(err, ErrInvalidCost) {
+			t.Errorf("global Reserve(%d): got %v, want ErrInvalidCost", cost, err)
+		}
+		if _, err := global.RetryAfter(cost); !errors.Is(err, ErrInvalidCost) {
+			t.Errorf("global RetryAfter(%d): got %v, want ErrInvalidCost", cost, err)
+		}
+	}
+	if tokens := global.Tokens(); tokens != 2 {
+		t.Errorf("tokens %d after invalid costs, want 2", tokens)
+	}
+}
+
+const benchInactiveClients = 200_000
+
+// fillInactive adds n clients whose only request is an hour old.
+func fillInactive(s *InMemoryTimeLogStore, n int) {
+	old := time.Now().Add(-time.Hour)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range n {
+		k := "inactive-" + strconv.Itoa(i)
+		s.logs[k] = []time.Time{old}
+		s.lastSeen.Set(k, old)
+		s.len++
+	}
+}
+
+// removeInactiveClientsFullScan is the sweep from before the lastSeen queue:
+// one pass over every client under a single lock acquisition.
+func removeInactiveClientsFullScan(s *InMemoryTimeLogStore, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keysToDelete := []string{}
+	for key, val := range s.logs {
+		if len(val) > 0 && time.Since(val[len(val)-1]) > ttl {
+			keysToDelete = append(keysToDelete, key)
+		}
+	}
+	for _, key := range keysToDelete {
+		delete(s.logs, key)
+		s.lastSeen.Remove(key)
+		s.len--
+	}
+}
+
+// BenchmarkRemoveInactiveClients sweeps many idle clients while another
+// goroutine keeps calling Add, and reports the longest that Add waited,
+// which is about the longest the sweep held the lock.
+func BenchmarkRemoveInactiveClients(b *testing.B) {
+	sweeps := map[string]func(*InMemoryTimeLogStore, time.Duration){
+		"queue":    func(s *InMemoryTimeLogStore, ttl time.Duration) { s.RemoveInactiveClients(ttl) },
+		"fullScan": removeInactiveClientsFullScan,
+	}
+
+	for name, sweep := range sweeps {
+		b.Run(name, func(b *testing.B) {
+			var maxWait time.Duration
+			for range b.N {
+				b.StopTimer()
+				store := NewInMemoryTimeLogStore(benchInactiveClients+1, 10)
+				fillInactive(store, benchInactiveClients)
+				var stop atomic.Bool
+				var wg sync.WaitGroup
+				var probeMax time.Duration
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for !stop.Load() {
+						start := time.Now()
+						store.Add("active", time.Hour, 1)
+						probeMax = max(probeMax, time.Since(start))
+						store.RemoveClient("active")
+					}
+				}()
+				b.StartTimer()
+
+				sweep(store, time.Minute)
+
+				b.StopTimer()
+				stop.Store(true)
+				wg.Wait()
+				if store.Len() != 0 {
+					b.Fatalf("%d clients left after the sweep", store.Len())
+				}
+				maxWait = max(maxWait, probeMax)
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(maxWait.Microseconds()), "max-wait-µs")
+		})
+	}
+}
+
+// BenchmarkTimeLogStoreParallel compares one lock over every client with
+// per-shard locks, clients spread over many keys.
+func BenchmarkTimeLogStoreParallel(b *testing.B) {
+	const clients = 10_000
+	stores := map[string]func() TimeLogStore{
+		"singleLock": func() TimeLogStore { return NewInMemoryTimeLogStore(clients, 100) },
+		"sharded":    func() TimeLogStore { return NewShardedTimeLogStore(shard.Count(), clients, 100) },
+	}
+
+	for name, newStore := range stores {
+		b.Run(name, func(b *testing.B) {
+			store := newStore()
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(next.Add(1)) * 7919
+				for pb.Next() {
+					store.Add("client-"+strconv.Itoa(i%clients), time.Millisecond, 1)
+					i++
+				}
+			})
+		})
+	}
+}
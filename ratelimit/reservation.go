@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCostExceedsCapacity = errors.New("Request cost exceeds the bucket capacity.")
+	ErrWaitExceedsDeadline = errors.New("Waiting for the limiter would exceed the context deadline.")
+)
+
+// Reservation holds tokens or window slots until its time comes. Callers
+// either wait out Delay and act, or Cancel to give the capacity back.
+type Reservation struct {
+	at     time.Time
+	cancel func()
+	once   sync.Once
+}
+
+// At is when the reserved action may happen.
+func (r *Reservation) At() time.Time {
+	return r.at
+}
+
+// Delay is how long to wait before acting, zero once At has passed.
+func (r *Reservation) Delay() time.Duration {
+	return max(time.Until(r.at), 0)
+}
+
+// Cancel refunds what the reservation took, so it can be used by others.
+// Only the first call has any effect, and none once At has passed: the
+// capacity is then considered used, like with golang.org/x/time/rate.
+func (r *Reservation) Cancel() {
+	if time.Now().After(r.at) {
+		return
+	}
+	r.once.Do(r.cancel)
+}
+
+// wait blocks until r's time comes, cancelling r when ctx ends first or
+// would end before then.
+func wait(ctx context.Context, r *Reservation) error {
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(r.at) {
+		r.Cancel()
+		return ErrWaitExceedsDeadline
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
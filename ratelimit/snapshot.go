@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// limiterSnapshotVersion is bumped whenever LimiterSnapshot changes shape.
+const limiterSnapshotVersion = 1
+
+// TokenSetter is implemented by token stores that can be restored from a snapshot.
+type TokenSetter interface {
+	SetTokens(count int)
+}
+
+// TimeLogSnapshotter is implemented by time log stores that can be snapshotted.
+type TimeLogSnapshotter interface {
+	SnapshotLogs() map[string][]time.Time
+	RestoreLogs(logs map[string][]time.Time, w time.Duration)
+}
+
+type BucketSnapshot struct {
+	Tokens int `json:"tokens"`
+	Cap    int `json:"cap"`
+}
+
+// LimiterSnapshot is the limiter state persisted between restarts.
+type LimiterSnapshot struct {
+	Version   int                               `json:"version"`
+	TakenAt   time.Time                         `json:"takenAt"`
+	Global    *BucketSnapshot                   `json:"global,omitempty"`
+	PerClient map[string]map[string][]time.Time `json:"perClient,omitempty"` // limiter name -> client -> request times
+}
+
+var (
+	ErrSnapshotCorrupt         = errors.New("Limiter snapshot is corrupt.")
+	ErrSnapshotVersionMismatch = errors.New("Limiter snapshot version is not supported.")
+)
+
+// SaveSnapshot writes the state of global and every per-client limiter
+// to path. The file is written to a temporary file first and renamed, so a
+// crash mid-write never leaves a truncated snapshot behind.
+func SaveSnapshot(path string, global *GlobalRateLimiter, perClient map[string]*PerClientRateLimiter) error {
+	snapshot := LimiterSnapshot{
+		Version:   limiterSnapshotVersion,
+		TakenAt:   time.Now(),
+		PerClient: make(map[string]map[string][]time.Time, len(perClient)),
+	}
+
+	if global != nil {
+		bucket := global.Snapshot()
+		snapshot.Global = &bucket
+	}
+	for name, limiter := range perClient {
+		logs, err := limiter.Snapshot()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		snapshot.PerClient[name] = logs
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(&snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// RestoreSnapshot loads a snapshot written by SaveSnapshot. A
+// missing file is not an error and returns false. Entries that went stale
+// while the server was down are discarded by the limiters themselves.
+func RestoreSnapshot(path string, global *GlobalRateLimiter, perClient map[string]*PerClientRateLimiter) (bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var snapshot LimiterSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return false, fmt.Errorf("%w %v", ErrSnapshotCorrupt, err)
+	}
+	if snapshot.Version != limiterSnapshotVersion {
+		return false, fmt.Errorf("%w got %d, expected %d", ErrSnapshotVersionMismatch, snapshot.Version, limiterSnapshotVersion)
+	}
+	if snapshot.TakenAt.IsZero() || snapshot.TakenAt.After(time.Now()) {
+		return false, fmt.Errorf("%w invalid timestamp %v", ErrSnapshotCorrupt, snapshot.TakenAt)
+	}
+
+	if global != nil && snapshot.Global != nil {
+		if err := global.Restore(*snapshot.Global, snapshot.TakenAt); err != nil {
+			return false, err
+		}
+	}
+	for name, limiter := range perClient {
+		if logs, ok := snapshot.PerClient[name]; ok {
+			if err := limiter.Restore(logs); err != nil {
+				return false, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/dessources/go_rate_limiter/ratelimit"
+	"github.com/dessources/go_rate_limiter/ratelimit/envoyrls"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+)
+
+// StartRateLimitService serves the Envoy RateLimitService API on cfg.RlsAddr
+// with the limits in cfg.RlsConfigPath. Reflection is enabled so it can be
+// queried with a plain gRPC client such as grpcurl. The returned stop
+// function drains in-flight calls.
+func StartRateLimitService(logger *slog.Logger, cfg *Config) (func(), error) {
+	domains, err := envoyrls.LoadConfig(cfg.RlsConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	rls, err := envoyrls.NewServer(domains, envoyrls.Options{
+		NewLimiter: func(limit int, window time.Duration) (*ratelimit.PerClientRateLimiter, error) {
+			return newPerClientRateLimiter(cfg.StorageType, cfg.PerClientLimiterCap, limit, window, window)
+		},
+		OnDecision: func(domain, key string, allowed bool) {
+			if !allowed {
+				logger.Warn("rate limit service descriptor over limit", "domain", domain, "descriptor", key)
+			}
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", cfg.RlsAddr)
+	if err != nil {
+		rls.Offline()
+		return nil, err
+	}
+
+	server := grpc.NewServer()
+	rlsv3.RegisterRateLimitServiceServer(server, rls)
+	reflection.Register(server)
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.Error("rate limit service stopped", "error", err)
+		}
+	}()
+	logger.Info("rate limit service starting", "addr", listener.Addr().String(), "domains", len(domains))
+
+	return func() {
+		server.GracefulStop()
+		rls.Offline()
+	}, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+)
+
+var ErrQueueFull = errors.New("Too many stress tests are waiting to run. Please try again later.")
+
+type queueTicket struct {
+	granted chan struct{}
+	moved   chan struct{} // signalled when the ticket moves up the queue
+}
+
+// RunQueue lets a fixed number of runs proceed at once and makes the rest
+// wait their turn in arrival order.
+type RunQueue struct {
+	slots      int
+	maxWaiting int
+	running    int
+	waiting    []*queueTicket
+	mu         sync.Mutex
+}
+
+func NewRunQueue(slots, maxWaiting int) *RunQueue {
+	return &RunQueue{slots: max(slots, 1), maxWaiting: maxWaiting}
+}
+
+// Acquire blocks until a slot is free or ctx ends. While waiting, onPosition
+// is called with the 1-based queue position every time it changes. The
+// returned release must be called once the run is over.
+func (q *RunQueue) Acquire(ctx context.Context, onPosition func(position int)) (func(), error) {
+	q.mu.Lock()
+	if q.running < q.slots && len(q.waiting) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return q.releaseFunc(), nil
+	}
+	if len(q.waiting) >= q.maxWaiting {
+		q.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+
+	ticket := &queueTicket{granted: make(chan struct{}), moved: make(chan struct{}, 1)}
+	q.waiting = append(q.waiting, ticket)
+	position := len(q.waiting)
+	q.mu.Unlock()
+
+	onPosition(position)
+	for {
+		select {
+		case <-ticket.granted:
+			return q.releaseFunc(), nil
+
+		case <-ticket.moved:
+			q.mu.Lock()
+			position := slices.Index(q.waiting, ticket) + 1
+			q.mu.Unlock()
+			if position > 0 {
+				onPosition(position)
+			}
+
+		case <-ctx.Done():
+			q.mu.Lock()
+			if i := slices.Index(q.waiting, ticket); i >= 0 {
+				q.waiting = slices.Delete(q.waiting, i, i+1)
+				q.notifyFrom(i)
+				q.mu.Unlock()
+				return nil, ctx.Err()
+			}
+			q.mu.Unlock()
+
+			// granted at the same time, hand the slot on
+			q.releaseFunc()()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Waiting returns the number of runs waiting for a slot.
+func (q *RunQueue) Waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+func (q *RunQueue) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(q.release)
+	}
+}
+
+// release passes the slot to the first waiting run, or frees it.
+func (q *RunQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiting) == 0 {
+		q.running--
+		return
+	}
+
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	close(next.granted)
+	q.notifyFrom(0)
+}
+
+// notifyFrom tells every ticket from index i on that it moved up. It assumes
+// the caller holds q.mu.
+func (q *RunQueue) notifyFrom(i int) {
+	for _, ticket := range q.waiting[i:] {
+		select {
+		case ticket.moved <- struct{}{}:
+		default:
+			// already has a pending notification
+		}
+	}
+}
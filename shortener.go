@@ -1,186 +1,627 @@
-package main
-
-import (
-	"errors"
-	"fmt"
-	"math/rand/v2"
-	"strings"
-	"sync"
-	"time"
-)
-
-const (
-	MinAge     = time.Minute * 30
-	MinCap int = 10
-)
-
-type UrlShortener interface {
-	AddMapping(original, short string) (bool, error)
-	RetrieveUrl(short string) (string, error)
-	RemoveMapping(short string) error
-	RegularlyResetMappings()
-	Offline()
-	Cap() int
-	Len() int
-	ShortCodeLen() int
-}
-
-type UrlMapping struct {
-	originalUrl string
-	createdAt   time.Time
-}
-
-type InMemoryUrlShortener struct {
-	cap          int
-	len          int
-	shortCodeLen int
-	mapping      map[string]*UrlMapping
-	done         chan struct{}
-	ttl          time.Duration
-	mu           sync.RWMutex
-}
-
-func (m *InMemoryUrlShortener) AddMapping(original, short string) (bool, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if m.len < m.cap {
-		if m.mapping[short] != nil {
-			return true, nil
-		}
-		m.len++
-		m.mapping[short] = &UrlMapping{original, time.Now()}
-		return false, nil
-	} else {
-		return false, errors.New("Url map is full.")
-	}
-}
-
-func (m *InMemoryUrlShortener) RetrieveUrl(s string) (string, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	if mapping := m.mapping[s]; mapping != nil {
-		return mapping.originalUrl, nil
-	} else {
-		return "", errors.New("Url not found")
-	}
-}
-
-func (m *InMemoryUrlShortener) RemoveMapping(short string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if m.mapping[short] != nil {
-		delete(m.mapping, short)
-		m.len--
-		return nil
-	}
-
-	return errors.New("Url not found")
-}
-
-func (m *InMemoryUrlShortener) RegularlyResetMappings() {
-	ticker := time.NewTicker(m.ttl / 2)
-	for {
-		select {
-		case <-ticker.C:
-			m.mu.Lock()
-
-			for key, val := range m.mapping {
-				if time.Since(val.createdAt) > m.ttl {
-
-					delete(m.mapping, key)
-					m.len--
-				}
-			}
-			m.mu.Unlock()
-		case <-m.done:
-			ticker.Stop()
-			return
-		}
-	}
-}
-
-func (m *InMemoryUrlShortener) Cap() int {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return m.cap
-}
-func (m *InMemoryUrlShortener) Len() int {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return m.len
-}
-
-func (m *InMemoryUrlShortener) ShortCodeLen() int {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return m.shortCodeLen
-}
-
-func (m *InMemoryUrlShortener) Offline() {
-	close(m.done)
-}
-
-func NewUrlShortener(storageType StorageType, cap int, ttl time.Duration, ShortCodeLength int) (UrlShortener, error) {
-	if cap < MinCap {
-		return nil, fmt.Errorf("Capacity has to be at least %d", MinCap)
-	}
-	if ttl < MinAge {
-		return nil, fmt.Errorf("Time to live has to be at least %v ", MinAge)
-	}
-
-	var urlShortener UrlShortener
-
-	switch storageType {
-	case InMemory:
-		done := make(chan struct{})
-		mapping := make(map[string]*UrlMapping)
-		urlShortener = &InMemoryUrlShortener{cap: cap, done: done, ttl: ttl, mapping: mapping, shortCodeLen: ShortCodeLength}
-
-		// reset mappings every hour
-		go urlShortener.RegularlyResetMappings()
-
-		return urlShortener, nil
-	case Redis:
-		return nil, errors.New("Redis storage not yet implemented")
-	}
-
-	return nil, errors.New("Unknown error in initializing url shortener.")
-}
-
-//--------------------------------------------------------------------------
-// Shorten functionality definition
-//-------------------------------------------------------------------------
-
-var charTypes = [3]rune{'0', 'A', 'a'} // ascii start value for numbers, upper & lower letters
-
-func Shorten(s UrlShortener, original string) (string, error) {
-
-	var shortUrl string
-	var assumeCollision = true
-
-	for assumeCollision {
-		var result strings.Builder
-		var charPos int
-		var charType int
-		for range s.ShortCodeLen() {
-
-			if charType = rand.IntN(3); charType == 0 {
-				charPos = rand.IntN(10)
-			} else {
-				charPos = rand.IntN(26)
-			}
-
-			char := charTypes[charType] + rune(charPos)
-			result.WriteRune(char)
-		}
-
-		shortUrl = result.String()
-		if match, err := s.AddMapping(original, shortUrl); err != nil {
-			return "", err
-		} else if !match {
-			assumeCollision = false
-		}
-	}
-
-	return shortUrl, nil
-}
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dessources/go_rate_limiter/internal/expiry"
+	"github.com/dessources/go_rate_limiter/internal/shard"
+)
+
+const (
+	MinAge     = time.Minute * 30
+	MinCap int = 10
+)
+
+var (
+	ErrAliasTaken    = errors.New("Alias is already taken.")
+	ErrShortenerFull = errors.New("Url map is full.")
+)
+
+// EvictionPolicy decides what AddMapping does once the shortener is at capacity.
+type EvictionPolicy int
+
+const (
+	EvictReject               EvictionPolicy = iota // refuse new mappings
+	EvictOldest                                     // drop the mapping with the earliest createdAt
+	EvictLeastRecentlyClicked                       // drop the mapping clicked least recently
+)
+
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch s {
+	case "", "reject":
+		return EvictReject, nil
+	case "oldest":
+		return EvictOldest, nil
+	case "lru":
+		return EvictLeastRecentlyClicked, nil
+	}
+	return EvictReject, fmt.Errorf("unknown eviction policy %q, expected reject, oldest or lru", s)
+}
+
+// AddResult describes what adding a mapping did besides storing it.
+type AddResult struct {
+	Taken    bool   // short already holds a mapping, nothing was stored
+	Existing string // the owner's live code for the same destination, returned instead of storing
+	Evicted  string // live code dropped to make room
+}
+
+type UrlShortener interface {
+	AddMapping(short string, mapping UrlMapping) (AddResult, error)
+	FindOrAddMapping(short string, mapping UrlMapping) (AddResult, error)
+	RetrieveUrl(short string) (UrlMapping, error)
+	RecordClick(short string)
+	FindMapping(mapping UrlMapping) (string, bool)
+	RemoveMapping(short string) error
+	Codes() []string
+	RegularlyResetMappings()
+	Offline()
+	Cap() int
+	Len() int
+	ShortCodeLen() int
+}
+
+type UrlMapping struct {
+	originalUrl    string
+	owner          string
+	passwordHash   []byte // bcrypt hash, nil when the link is not protected
+	redirectStatus int    // 0 means DefaultRedirectStatus
+	createdAt      time.Time
+	expiresAt      time.Time
+}
+
+const DefaultRedirectStatus = http.StatusTemporaryRedirect
+
+func IsValidRedirectStatus(status int) bool {
+	switch status {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func (m UrlMapping) RedirectStatus() int {
+	if m.redirectStatus == 0 {
+		return DefaultRedirectStatus
+	}
+	return m.redirectStatus
+}
+
+// dedupable reports whether the mapping may be shared with identical requests.
+// Protected links carry their own password and are never reused.
+func (m UrlMapping) dedupable() bool {
+	return m.owner != "" && m.passwordHash == nil
+}
+
+// destinationKey identifies a destination per owner in the reverse index.
+// Links redirecting with different status codes are kept apart.
+func destinationKey(m UrlMapping) string {
+	return fmt.Sprintf("%s\x00%d\x00%s", m.owner, m.RedirectStatus(), NormalizeUrl(m.originalUrl))
+}
+
+type InMemoryUrlShortener struct {
+	cap          int
+	len          int
+	slots        *shard.Slots // shared with the other shards of a ShardedUrlShortener
+	shortCodeLen int
+	dedupe       bool
+	mapping      map[string]*UrlMapping
+	destinations map[string]string // destinationKey -> short code, only used when dedupe is on
+	eviction     EvictionPolicy
+	// eviction candidates by createdAt, or by last click with
+	// EvictLeastRecentlyClicked; nil with EvictReject
+	evictionQueue *expiry.Queue
+	// clicks recorded under the read lock, moved into evictionQueue when
+	// the code reaches its front
+	lastClicks map[string]*atomic.Int64
+	expiry     *expiry.Queue // codes ordered by expiresAt
+	done       chan struct{}
+	ttl        time.Duration
+	mu         sync.RWMutex
+}
+
+func (m *InMemoryUrlShortener) AddMapping(short string, mapping UrlMapping) (AddResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.addLocked(short, mapping)
+}
+
+// FindOrAddMapping returns the owner's live code for the same destination
+// when deduplicating, and otherwise stores mapping under short, all under one
+// lock so concurrent shortens of a destination agree on a single code.
+func (m *InMemoryUrlShortener) FindOrAddMapping(short string, mapping UrlMapping) (AddResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dedupe && mapping.dedupable() {
+		if existing, ok := m.destinations[destinationKey(mapping)]; ok {
+			return AddResult{Existing: existing}, nil
+		}
+	}
+	return m.addLocked(short, mapping)
+}
+
+// addLocked assumes caller holds m.mu.Lock()
+func (m *InMemoryUrlShortener) addLocked(short string, mapping UrlMapping) (AddResult, error) {
+	var result AddResult
+	if m.mapping[short] != nil {
+		result.Taken = true
+		return result, nil
+	}
+
+	if !m.acquireSlot() {
+		if m.slots != nil {
+			// ShardedUrlShortener evicts across shards
+			return result, ErrShortenerFull
+		}
+		if result.Evicted = m.evictLocked(); result.Evicted == "" {
+			return result, ErrShortenerFull
+		}
+	}
+
+	m.len++
+	// imported mappings keep their original timestamps
+	if mapping.createdAt.IsZero() {
+		mapping.createdAt = time.Now()
+	}
+	if mapping.expiresAt.IsZero() {
+		mapping.expiresAt = mapping.createdAt.Add(m.ttl)
+	}
+	m.mapping[short] = &mapping
+	m.expiry.Set(short, mapping.expiresAt)
+	switch m.eviction {
+	case EvictOldest:
+		m.evictionQueue.Set(short, mapping.createdAt)
+	case EvictLeastRecentlyClicked:
+		// a new link counts as just clicked, whatever its createdAt
+		now := time.Now()
+		m.evictionQueue.Set(short, now)
+		m.lastClicks[short] = &atomic.Int64{}
+		m.lastClicks[short].Store(now.UnixNano())
+	}
+
+	if m.dedupe && mapping.dedupable() {
+		key := destinationKey(mapping)
+		// an alias or import of the same destination keeps the first live code
+		if _, exists := m.destinations[key]; !exists {
+			m.destinations[key] = short
+		}
+	}
+	return result, nil
+}
+
+// acquireSlot reports whether there is room for one more mapping.
+// Assumes caller holds m.mu.Lock()
+func (m *InMemoryUrlShortener) acquireSlot() bool {
+	if m.slots != nil {
+		return m.slots.Acquire()
+	}
+	return m.len < m.cap
+}
+
+// evictionCandidateLocked returns the code evictLocked would remove and the
+// time it is ordered by. Clicks recorded since a code was queued send it
+// back in line first. Assumes caller holds m.mu.Lock()
+func (m *InMemoryUrlShortener) evictionCandidateLocked() (string, time.Time, bool) {
+	if m.evictionQueue == nil {
+		return "", time.Time{}, false
+	}
+	for {
+		short, at, ok := m.evictionQueue.Peek()
+		if !ok {
+			return "", time.Time{}, false
+		}
+		if clicked, ok := m.lastClicks[short]; ok {
+			if last := time.Unix(0, clicked.Load()); last.After(at) {
+				m.evictionQueue.Set(short, last)
+				continue
+			}
+		}
+		return short, at, true
+	}
+}
+
+// evictLocked removes the front of the eviction queue and returns its code,
+// or "" when nothing can be evicted. Assumes caller holds m.mu.Lock()
+func (m *InMemoryUrlShortener) evictLocked() string {
+	short, _, ok := m.evictionCandidateLocked()
+	if !ok {
+		return ""
+	}
+	m.removeLocked(short)
+	return short
+}
+
+// FindMapping returns the live short code the owner already has for the same
+// destination, if deduplication is enabled.
+func (m *InMemoryUrlShortener) FindMapping(mapping UrlMapping) (string, bool) {
+	if !m.dedupe || !mapping.dedupable() {
+		return "", false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	short, ok := m.destinations[destinationKey(mapping)]
+	return short, ok
+}
+
+// removeLocked assumes caller holds m.mu.Lock()
+func (m *InMemoryUrlShortener) removeLocked(short string) bool {
+	mapping := m.mapping[short]
+	if mapping == nil {
+		return false
+	}
+
+	if m.dedupe && mapping.dedupable() {
+		key := destinationKey(*mapping)
+		if m.destinations[key] == short {
+			delete(m.destinations, key)
+		}
+	}
+	if m.evictionQueue != nil {
+		m.evictionQueue.Remove(short)
+		delete(m.lastClicks, short)
+	}
+	m.expiry.Remove(short)
+	delete(m.mapping, short)
+	m.len--
+	if m.slots != nil {
+		m.slots.Release(1)
+	}
+	return true
+}
+
+func (m *InMemoryUrlShortener) RetrieveUrl(s string) (UrlMapping, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if mapping := m.mapping[s]; mapping != nil {
+		return *mapping, nil
+	} else {
+		return UrlMapping{}, errors.New("Url not found")
+	}
+}
+
+// RecordClick marks short as just followed, which only matters to the
+// least recently clicked eviction policy. It only takes the read lock, so
+// redirects don't serialize on each other.
+func (m *InMemoryUrlShortener) RecordClick(short string) {
+	if m.eviction != EvictLeastRecentlyClicked {
+		return
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if clicked, ok := m.lastClicks[short]; ok {
+		clicked.Store(time.Now().UnixNano())
+	}
+}
+
+func (m *InMemoryUrlShortener) RemoveMapping(short string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.removeLocked(short) {
+		return nil
+	}
+
+	return errors.New("Url not found")
+}
+
+// Codes returns a snapshot of every stored short code.
+func (m *InMemoryUrlShortener) Codes() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	codes := make([]string, 0, len(m.mapping))
+	for short := range m.mapping {
+		codes = append(codes, short)
+	}
+	return codes
+}
+
+func (m *InMemoryUrlShortener) RegularlyResetMappings() {
+	ticker := time.NewTicker(min(m.ttl/2, expiry.SweepInterval))
+	for {
+		select {
+		case <-ticker.C:
+			m.removeExpiredMappings()
+		case <-m.done:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// removeExpiredMappings pops expired codes off the expiry queue in batches,
+// releasing the lock between batches so redirects are never stalled for long.
+func (m *InMemoryUrlShortener) removeExpiredMappings() {
+	now := time.Now()
+	for {
+		m.mu.Lock()
+		expired := m.expiry.PopBefore(now, expiry.BatchSize)
+		for _, short := range expired {
+			m.removeLocked(short)
+		}
+		m.mu.Unlock()
+
+		if len(expired) < expiry.BatchSize {
+			return
+		}
+	}
+}
+
+func (m *InMemoryUrlShortener) Cap() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cap
+}
+func (m *InMemoryUrlShortener) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.len
+}
+
+func (m *InMemoryUrlShortener) ShortCodeLen() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.shortCodeLen
+}
+
+func (m *InMemoryUrlShortener) Offline() {
+	close(m.done)
+}
+
+func newInMemoryUrlShortener(cap int, ttl time.Duration, shortCodeLen int, dedupe bool, eviction EvictionPolicy) *InMemoryUrlShortener {
+	shortener := &InMemoryUrlShortener{
+		cap:          cap,
+		shortCodeLen: shortCodeLen,
+		dedupe:       dedupe,
+		mapping:      make(map[string]*UrlMapping),
+		destinations: make(map[string]string),
+		eviction:     eviction,
+		expiry:       expiry.New(),
+		done:         make(chan struct{}),
+		ttl:          ttl,
+	}
+	if eviction != EvictReject {
+		shortener.evictionQueue = expiry.New()
+	}
+	if eviction == EvictLeastRecentlyClicked {
+		shortener.lastClicks = make(map[string]*atomic.Int64)
+	}
+	return shortener
+}
+
+// ShardedUrlShortener partitions codes across independently locked
+// InMemoryUrlShorteners. The shards share one capacity, and eviction picks
+// the earliest candidate of all shards.
+type ShardedUrlShortener struct {
+	shards       []*InMemoryUrlShortener
+	slots        *shard.Slots
+	eviction     EvictionPolicy
+	dedupe       bool
+	dedupeLocks  [64]sync.Mutex // by destination, destinations span shards
+	shortCodeLen int
+	ttl          time.Duration
+	done         chan struct{}
+}
+
+func NewShardedUrlShortener(shards, cap int, ttl time.Duration, shortCodeLen int, dedupe bool, eviction EvictionPolicy) *ShardedUrlShortener {
+	shortener := &ShardedUrlShortener{
+		shards:       make([]*InMemoryUrlShortener, shards),
+		slots:        shard.NewSlots(cap),
+		eviction:     eviction,
+		dedupe:       dedupe,
+		shortCodeLen: shortCodeLen,
+		ttl:          ttl,
+		done:         make(chan struct{}),
+	}
+	for i := range shortener.shards {
+		shortener.shards[i] = newInMemoryUrlShortener(cap, ttl, shortCodeLen, dedupe, eviction)
+		shortener.shards[i].slots = shortener.slots
+	}
+	return shortener
+}
+
+func (m *ShardedUrlShortener) shard(short string) *InMemoryUrlShortener {
+	return m.shards[shard.Index(short, len(m.shards))]
+}
+
+func (m *ShardedUrlShortener) AddMapping(short string, mapping UrlMapping) (AddResult, error) {
+	result, err := m.shard(short).AddMapping(short, mapping)
+	if !errors.Is(err, ErrShortenerFull) || m.eviction == EvictReject {
+		return result, err
+	}
+
+	evicted := m.evict()
+	if evicted == "" {
+		return result, err
+	}
+	result, err = m.shard(short).AddMapping(short, mapping)
+	result.Evicted = evicted
+	return result, err
+}
+
+// evict removes the earliest eviction candidate of all shards.
+func (m *ShardedUrlShortener) evict() string {
+	var oldest *InMemoryUrlShortener
+	var oldestAt time.Time
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		_, at, ok := shard.evictionCandidateLocked()
+		shard.mu.Unlock()
+		if ok && (oldest == nil || at.Before(oldestAt)) {
+			oldest, oldestAt = shard, at
+		}
+	}
+	if oldest == nil {
+		return ""
+	}
+
+	oldest.mu.Lock()
+	defer oldest.mu.Unlock()
+	return oldest.evictLocked()
+}
+
+// FindOrAddMapping holds the destination's lock across the lookup in every
+// shard and the add, since the new code may land in another shard.
+func (m *ShardedUrlShortener) FindOrAddMapping(short string, mapping UrlMapping) (AddResult, error) {
+	if !m.dedupe || !mapping.dedupable() {
+		return m.AddMapping(short, mapping)
+	}
+
+	lock := &m.dedupeLocks[shard.Index(destinationKey(mapping), len(m.dedupeLocks))]
+	lock.Lock()
+	defer lock.Unlock()
+	if existing, ok := m.FindMapping(mapping); ok {
+		return AddResult{Existing: existing}, nil
+	}
+	return m.AddMapping(short, mapping)
+}
+
+func (m *ShardedUrlShortener) RetrieveUrl(short string) (UrlMapping, error) {
+	return m.shard(short).RetrieveUrl(short)
+}
+
+func (m *ShardedUrlShortener) RecordClick(short string) {
+	m.shard(short).RecordClick(short)
+}
+
+// FindMapping asks every shard, since shards are keyed by code rather than
+// by destination.
+func (m *ShardedUrlShortener) FindMapping(mapping UrlMapping) (string, bool) {
+	for _, shard := range m.shards {
+		if short, ok := shard.FindMapping(mapping); ok {
+			return short, true
+		}
+	}
+	return "", false
+}
+
+func (m *ShardedUrlShortener) RemoveMapping(short string) error {
+	return m.shard(short).RemoveMapping(short)
+}
+
+func (m *ShardedUrlShortener) Codes() []string {
+	codes := []string{}
+	for _, shard := range m.shards {
+		codes = append(codes, shard.Codes()...)
+	}
+	return codes
+}
+
+func (m *ShardedUrlShortener) RegularlyResetMappings() {
+	ticker := time.NewTicker(min(m.ttl/2, expiry.SweepInterval))
+	for {
+		select {
+		case <-ticker.C:
+			for _, shard := range m.shards {
+				shard.removeExpiredMappings()
+			}
+		case <-m.done:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+func (m *ShardedUrlShortener) Offline() {
+	close(m.done)
+}
+
+func (m *ShardedUrlShortener) Cap() int {
+	return m.slots.Cap()
+}
+
+func (m *ShardedUrlShortener) Len() int {
+	return m.slots.Len()
+}
+
+func (m *ShardedUrlShortener) ShortCodeLen() int {
+	return m.shortCodeLen
+}
+
+func NewUrlShortener(storageType StorageType, cap int, ttl time.Duration, ShortCodeLength int, dedupe bool, eviction EvictionPolicy) (UrlShortener, error) {
+	if cap < MinCap {
+		return nil, fmt.Errorf("Capacity has to be at least %d", MinCap)
+	}
+	if ttl < MinAge {
+		return nil, fmt.Errorf("Time to live has to be at least %v ", MinAge)
+	}
+
+	var urlShortener UrlShortener
+
+	switch storageType {
+	case InMemory:
+		urlShortener = newInMemoryUrlShortener(cap, ttl, ShortCodeLength, dedupe, eviction)
+
+		// remove mappings as they expire
+		go urlShortener.RegularlyResetMappings()
+
+		return urlShortener, nil
+	case ShardedInMemory:
+		urlShortener = NewShardedUrlShortener(shard.Count(), cap, ttl, ShortCodeLength, dedupe, eviction)
+
+		go urlShortener.RegularlyResetMappings()
+
+		return urlShortener, nil
+	case Redis:
+		return nil, errors.New("Redis storage not yet implemented")
+	}
+
+	return nil, errors.New("Unknown error in initializing url shortener.")
+}
+
+//--------------------------------------------------------------------------
+// Shorten functionality definition
+//-------------------------------------------------------------------------
+
+var charTypes = [3]rune{'0', 'A', 'a'} // ascii start value for numbers, upper & lower letters
+
+// Shorten returns a new short code for mapping, or the owner's existing code
+// for the same destination when the shortener deduplicates, in which case
+// result.Existing is set.
+func Shorten(s UrlShortener, mapping UrlMapping) (string, AddResult, error) {
+	for {
+		var code strings.Builder
+		var charPos int
+		var charType int
+		for range s.ShortCodeLen() {
+
+			if charType = rand.IntN(3); charType == 0 {
+				charPos = rand.IntN(10)
+			} else {
+				charPos = rand.IntN(26)
+			}
+
+			char := charTypes[charType] + rune(charPos)
+			code.WriteRune(char)
+		}
+
+		shortUrl := code.String()
+		result, err := s.FindOrAddMapping(shortUrl, mapping)
+		if err != nil {
+			return "", result, err
+		} else if result.Existing != "" {
+			return result.Existing, result, nil
+		} else if !result.Taken {
+			return shortUrl, result, nil
+		}
+	}
+}
+
+// ShortenWithAlias stores mapping under a caller-chosen alias, and returns
+// the code evicted to make room, if any.
+func ShortenWithAlias(s UrlShortener, alias string, mapping UrlMapping) (string, error) {
+	result, err := s.AddMapping(alias, mapping)
+	if err != nil {
+		return "", err
+	}
+	if result.Taken {
+		return "", ErrAliasTaken
+	}
+	return result.Evicted, nil
+}
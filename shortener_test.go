@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dessources/go_rate_limiter/internal/shard"
+)
+
+// BenchmarkUrlShortenerParallel compares one lock over every mapping with
+// per-shard locks. Each iteration adds, follows and removes its own code.
+func BenchmarkUrlShortenerParallel(b *testing.B) {
+	const cap = 100_000
+	shorteners := map[string]func() UrlShortener{
+		"singleLock": func() UrlShortener { return newInMemoryUrlShortener(cap, time.Hour, 8, false, EvictReject) },
+		"sharded": func() UrlShortener {
+			return NewShardedUrlShortener(shard.Count(), cap, time.Hour, 8, false, EvictReject)
+		},
+	}
+
+	for name, newShortener := range shorteners {
+		b.Run(name, func(b *testing.B) {
+			shortener := newShortener()
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					code := strconv.FormatInt(next.Add(1), 36)
+					if _, err := shortener.AddMapping(code, UrlMapping{originalUrl: "https://example.com/" + code}); err != nil {
+						b.Error(err)
+						return
+					}
+					shortener.RetrieveUrl(code)
+					shortener.RemoveMapping(code)
+				}
+			})
+		})
+	}
+}
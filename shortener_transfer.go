@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MappingRecord is one line of a JSONL export.
+type MappingRecord struct {
+	Code           string    `json:"code"`
+	Destination    string    `json:"destination"`
+	CreatedAt      time.Time `json:"createdAt"`
+	Owner          string    `json:"owner,omitempty"`
+	ExpiresAt      time.Time `json:"expiresAt"`
+	PasswordHash   string    `json:"passwordHash,omitempty"` // bcrypt hash of protected links
+	RedirectStatus int       `json:"redirectStatus,omitempty"`
+}
+
+type ConflictPolicy string
+
+const (
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictFail      ConflictPolicy = "fail"
+)
+
+func ParseConflictPolicy(s string) (ConflictPolicy, bool) {
+	switch policy := ConflictPolicy(s); policy {
+	case "":
+		return ConflictSkip, true
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+		return policy, true
+	}
+	return "", false
+}
+
+// maxReportedImportErrors bounds the summary size for badly broken files.
+const maxReportedImportErrors = 100
+
+type ImportError struct {
+	Line    int    `json:"line"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+type ImportSummary struct {
+	Imported    int           `json:"imported"`
+	Overwritten int           `json:"overwritten"`
+	Skipped     int           `json:"skipped"`
+	Expired     int           `json:"expired"`
+	Invalid     int           `json:"invalid"`
+	Evicted     int           `json:"evicted"`     // live links dropped to make room
+	NotImported int           `json:"notImported"` // left out because the import was aborted
+	Aborted     bool          `json:"aborted"`
+	Reason      string        `json:"reason,omitempty"`
+	Errors      []ImportError `json:"errors,omitempty"`
+}
+
+func (s *ImportSummary) addError(line int, code, message string) {
+	s.Invalid++
+	if len(s.Errors) < maxReportedImportErrors {
+		s.Errors = append(s.Errors, ImportError{line, code, message})
+	}
+}
+
+func (s *ImportSummary) abort(reason string, remaining int) {
+	s.Aborted = true
+	s.Reason = reason
+	s.NotImported = remaining
+}
+
+// ExportMappings writes every live mapping of s as JSONL and returns the
+// number of records written. It only relies on the UrlShortener interface.
+func ExportMappings(s UrlShortener, w io.Writer) (int, error) {
+	encoder := json.NewEncoder(w)
+	written := 0
+
+	for _, code := range s.Codes() {
+		mapping, err := s.RetrieveUrl(code)
+		if err != nil {
+			// expired or removed since the snapshot
+			continue
+		}
+
+		record := MappingRecord{
+			Code:           code,
+			Destination:    mapping.originalUrl,
+			CreatedAt:      mapping.createdAt,
+			Owner:          mapping.owner,
+			ExpiresAt:      mapping.expiresAt,
+			PasswordHash:   string(mapping.passwordHash),
+			RedirectStatus: mapping.redirectStatus,
+		}
+		if err := encoder.Encode(&record); err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	return written, nil
+}
+
+type importEntry struct {
+	line    int
+	code    string
+	mapping UrlMapping
+}
+
+// ImportMappings loads a JSONL export into s. Malformed or invalid lines are
+// reported and left out; conflicts with existing codes are resolved with policy.
+// ConflictFail checks every record and the remaining capacity before writing
+// anything, so a failed import leaves s untouched.
+func ImportMappings(s UrlShortener, r io.Reader, policy ConflictPolicy, cfg *Config) (ImportSummary, error) {
+	var summary ImportSummary
+
+	entries, err := readImportEntries(r, &summary, cfg)
+	if err != nil {
+		return summary, err
+	}
+
+	if policy == ConflictFail {
+		newEntries := 0
+		for _, entry := range entries {
+			if _, err := s.RetrieveUrl(entry.code); err == nil {
+				summary.abort(fmt.Sprintf("Code %q already exists (line %d).", entry.code, entry.line), len(entries))
+				return summary, nil
+			}
+			newEntries++
+		}
+		if free := s.Cap() - s.Len(); newEntries > free {
+			summary.abort(fmt.Sprintf("Import needs %d free slots but only %d are left.", newEntries, free), len(entries))
+			return summary, nil
+		}
+	}
+
+	for i, entry := range entries {
+		overwrite := false
+		if _, err := s.RetrieveUrl(entry.code); err == nil {
+			if policy != ConflictOverwrite {
+				summary.Skipped++
+				continue
+			}
+			s.RemoveMapping(entry.code)
+			overwrite = true
+		}
+
+		added, err := s.AddMapping(entry.code, entry.mapping)
+		if err != nil {
+			summary.abort(err.Error(), len(entries)-i)
+			return summary, nil
+		}
+		if added.Evicted != "" {
+			summary.Evicted++
+		}
+		if added.Taken {
+			// created concurrently between the lookup and the add
+			summary.Skipped++
+			continue
+		}
+
+		if overwrite {
+			summary.Overwritten++
+		} else {
+			summary.Imported++
+		}
+	}
+
+	return summary, nil
+}
+
+// readImportEntries parses and validates every line, dropping expired records.
+func readImportEntries(r io.Reader, summary *ImportSummary, cfg *Config) ([]importEntry, error) {
+	scanner := bufio.NewScanner(r)
+	// a record is mostly its destination url
+	scanner.Buffer(make([]byte, 0, 64*1024), cfg.MaxUrlLength+64*1024)
+
+	seen := make(map[string]int)
+	entries := []importEntry{}
+	now := time.Now()
+	line := 0
+
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record MappingRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			summary.addError(line, "", "Malformed JSON record.")
+			continue
+		}
+
+		if message, ok := validateMappingRecord(&record, cfg); !ok {
+			summary.addError(line, record.Code, message)
+			continue
+		}
+
+		if previous, ok := seen[record.Code]; ok {
+			summary.addError(line, record.Code, fmt.Sprintf("Duplicate of line %d.", previous))
+			continue
+		}
+		seen[record.Code] = line
+
+		if !record.ExpiresAt.IsZero() && record.ExpiresAt.Before(now) {
+			summary.Expired++
+			continue
+		}
+
+		mapping := UrlMapping{
+			originalUrl:    record.Destination,
+			owner:          record.Owner,
+			redirectStatus: record.RedirectStatus,
+			createdAt:      record.CreatedAt,
+			expiresAt:      record.ExpiresAt,
+		}
+		if record.PasswordHash != "" {
+			mapping.passwordHash = []byte(record.PasswordHash)
+		}
+		entries = append(entries, importEntry{line, record.Code, mapping})
+	}
+
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, fmt.Errorf("line %d exceeds the maximum record size", line+1)
+		}
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func validateMappingRecord(record *MappingRecord, cfg *Config) (string, bool) {
+	maxCodeLength := max(cfg.MaxAliasLength, cfg.ShortCodeLength)
+	if record.Code == "" || len(record.Code) > maxCodeLength {
+		return fmt.Sprintf("Code must be between 1 and %d characters long.", maxCodeLength), false
+	}
+	for _, c := range record.Code {
+		if !isAliasChar(c) {
+			return "Code may only contain letters, digits, '-' and '_'.", false
+		}
+	}
+
+	if rejection, ok := ValidateUrl(record.Destination, cfg); !ok {
+		return rejection.ErrorMessage, false
+	}
+
+	if !IsValidRedirectStatus(record.RedirectStatus) {
+		return invalidRedirectStatusMessage, false
+	}
+
+	if record.PasswordHash != "" {
+		if _, err := bcrypt.Cost([]byte(record.PasswordHash)); err != nil {
+			return "Password hash is not a valid bcrypt hash.", false
+		}
+	}
+
+	return "", true
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultStressSuite is run when the stress test route gets no suite or scenario.
+	DefaultStressSuite = "default"
+	// regressionTolerance is the relative change from the baseline flagged as a regression.
+	regressionTolerance = 0.2
+	// regressionLatencyFloorMs keeps jitter on fast routes from being flagged.
+	regressionLatencyFloorMs = 1.0
+	// regressionRatioTolerance is how far the share of 5xx responses may rise over the baseline.
+	regressionRatioTolerance = 0.05
+)
+
+// suite and report names double as file names
+var stressFileName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,96}$`)
+
+// StressSuite is a scenario file: steps run in order against the same test
+// server, so a step can rely on the limiter state left by the previous ones.
+type StressSuite struct {
+	Name  string       `json:"name"`
+	Steps []StressStep `json:"steps"`
+}
+
+type StressStep struct {
+	LoadScenario
+	Expect []Expectation `json:"expect,omitempty"`
+}
+
+// Expectation is either a share of responses with a given status, e.g.
+// {"status": 429, "minRatio": 0.95}, or a bound on a summary metric, e.g.
+// {"metric": "p99Ms", "max": 50}.
+type Expectation struct {
+	Status   int      `json:"status,omitempty"`
+	MinRatio *float64 `json:"minRatio,omitempty"`
+	MaxRatio *float64 `json:"maxRatio,omitempty"`
+	Metric   string   `json:"metric,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+}
+
+var summaryMetrics = map[string]func(LoadSummary) float64{
+	"requests":       func(s LoadSummary) float64 { return float64(s.Requests) },
+	"errors":         func(s LoadSummary) float64 { return float64(s.Errors) },
+	"requestsPerSec": func(s LoadSummary) float64 { return s.RequestsPerSec },
+	"p50Ms":          func(s LoadSummary) float64 { return s.Latency.P50Ms },
+	"p90Ms":          func(s LoadSummary) float64 { return s.Latency.P90Ms },
+	"p99Ms":          func(s LoadSummary) float64 { return s.Latency.P99Ms },
+	"maxMs":          func(s LoadSummary) float64 { return s.Latency.MaxMs },
+}
+
+func (e Expectation) validate() error {
+	switch {
+	case e.Status != 0 && e.Metric != "":
+		return errors.New("An expectation checks either a status or a metric, not both.")
+	case e.Status != 0:
+		if e.MinRatio == nil && e.MaxRatio == nil {
+			return fmt.Errorf("Expectation on status %d needs minRatio or maxRatio.", e.Status)
+		}
+	case e.Metric != "":
+		if _, ok := summaryMetrics[e.Metric]; !ok {
+			return fmt.Errorf("Unknown metric %q.", e.Metric)
+		}
+		if e.Min == nil && e.Max == nil {
+			return fmt.Errorf("Expectation on %s needs min or max.", e.Metric)
+		}
+	default:
+		return errors.New("An expectation needs a status or a metric.")
+	}
+	return nil
+}
+
+func (e Expectation) String() string {
+	subject, low, high := e.Metric, e.Min, e.Max
+	if e.Status != 0 {
+		subject, low, high = fmt.Sprintf("share of %d responses", e.Status), e.MinRatio, e.MaxRatio
+	}
+
+	switch {
+	case low != nil && high != nil:
+		return fmt.Sprintf("%s between %g and %g", subject, *low, *high)
+	case low != nil:
+		return fmt.Sprintf("%s ≥ %g", subject, *low)
+	default:
+		return fmt.Sprintf("%s ≤ %g", subject, *high)
+	}
+}
+
+type ExpectationResult struct {
+	Expectation string  `json:"expectation"`
+	Actual      float64 `json:"actual"`
+	Passed      bool    `json:"passed"`
+}
+
+func (e Expectation) Check(summary LoadSummary) ExpectationResult {
+	var actual float64
+	low, high := e.Min, e.Max
+	if e.Status != 0 {
+		if responses := summary.Requests - summary.Errors; responses > 0 {
+			actual = float64(summary.StatusCounts[e.Status]) / float64(responses)
+		}
+		low, high = e.MinRatio, e.MaxRatio
+	} else {
+		actual = summaryMetrics[e.Metric](summary)
+	}
+
+	passed := (low == nil || actual >= *low) && (high == nil || actual <= *high)
+	return ExpectationResult{e.String(), math.Round(actual*1000) / 1000, passed}
+}
+
+// LoadStressSuite reads dir/name.json and validates every step.
+func LoadStressSuite(dir, name string) (StressSuite, error) {
+	var suite StressSuite
+	if !stressFileName.MatchString(name) {
+		return suite, errors.New("Suite names may only contain letters, digits, '-' and '_'.")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, name+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return suite, fmt.Errorf("Suite %q does not exist.", name)
+	} else if err != nil {
+		return suite, err
+	}
+
+	if err := json.Unmarshal(data, &suite); err != nil {
+		return suite, fmt.Errorf("Suite %q is not valid JSON: %v", name, err)
+	}
+	if suite.Name == "" {
+		suite.Name = name
+	}
+	if len(suite.Steps) == 0 {
+		return suite, fmt.Errorf("Suite %q has no steps.", name)
+	}
+
+	for i := range suite.Steps {
+		step := &suite.Steps[i]
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("Step %d", i+1)
+		}
+		if err := step.Validate(); err != nil {
+			return suite, fmt.Errorf("%s: %w", step.Name, err)
+		}
+		for _, expectation := range step.Expect {
+			if err := expectation.validate(); err != nil {
+				return suite, fmt.Errorf("%s: %w", step.Name, err)
+			}
+		}
+	}
+	return suite, nil
+}
+
+type StepReport struct {
+	Name         string              `json:"name"`
+	Scenario     LoadScenario        `json:"scenario"`
+	Summary      LoadSummary         `json:"summary"`
+	Expectations []ExpectationResult `json:"expectations"`
+	Regressions  []string            `json:"regressions,omitempty"`
+	Passed       bool                `json:"passed"`
+}
+
+type StressReport struct {
+	Id          string       `json:"id"`
+	Suite       string       `json:"suite"`
+	StartedAt   time.Time    `json:"startedAt"`
+	FinishedAt  time.Time    `json:"finishedAt"`
+	Baseline    string       `json:"baseline,omitempty"`
+	Steps       []StepReport `json:"steps"`
+	Passed      bool         `json:"passed"`
+	Regressions int          `json:"regressions"`
+}
+
+// NewStressReport starts the report of a run of suite, loaded from file.
+func NewStressReport(file, suite string, startedAt time.Time) *StressReport {
+	return &StressReport{
+		Id:        fmt.Sprintf("%s-%s", file, strings.Replace(startedAt.UTC().Format("20060102-150405.000"), ".", "-", 1)),
+		Suite:     suite,
+		StartedAt: startedAt,
+		Steps:     []StepReport{},
+		Passed:    true,
+	}
+}
+
+// AddStep checks the step's expectations and, when a baseline is given,
+// compares it with the baseline step of the same name.
+func (r *StressReport) AddStep(step StressStep, summary LoadSummary, baseline *StressReport) StepReport {
+	report := StepReport{Name: step.Name, Scenario: step.LoadScenario, Summary: summary, Expectations: []ExpectationResult{}, Passed: true}
+	for _, expectation := range step.Expect {
+		result := expectation.Check(summary)
+		report.Expectations = append(report.Expectations, result)
+		report.Passed = report.Passed && result.Passed
+	}
+
+	if baseline != nil {
+		for _, previous := range baseline.Steps {
+			if previous.Name == step.Name {
+				report.Regressions = compareWithBaseline(report, previous)
+				break
+			}
+		}
+	}
+
+	r.Steps = append(r.Steps, report)
+	r.Passed = r.Passed && report.Passed
+	r.Regressions += len(report.Regressions)
+	return report
+}
+
+func compareWithBaseline(current, previous StepReport) []string {
+	regressions := []string{}
+
+	for _, latency := range []struct {
+		name     string
+		now, was float64
+	}{
+		{"p50", current.Summary.Latency.P50Ms, previous.Summary.Latency.P50Ms},
+		{"p99", current.Summary.Latency.P99Ms, previous.Summary.Latency.P99Ms},
+	} {
+		if latency.now-latency.was > regressionLatencyFloorMs && latency.now > latency.was*(1+regressionTolerance) {
+			regressions = append(regressions, fmt.Sprintf("%s latency rose from %gms to %gms", latency.name, latency.was, latency.now))
+		}
+	}
+
+	// throughput only means something for steps that aren't paced by a rate
+	if current.Scenario.Rate == 0 && current.Summary.Requests > 100 &&
+		current.Summary.RequestsPerSec < previous.Summary.RequestsPerSec*(1-regressionTolerance) {
+		regressions = append(regressions, fmt.Sprintf("throughput fell from %.0f to %.0f req/s", previous.Summary.RequestsPerSec, current.Summary.RequestsPerSec))
+	}
+
+	if current.Summary.Errors > previous.Summary.Errors {
+		regressions = append(regressions, fmt.Sprintf("errors rose from %d to %d", previous.Summary.Errors, current.Summary.Errors))
+	}
+
+	if now, was := serverErrorRatio(current.Summary), serverErrorRatio(previous.Summary); now-was > regressionRatioTolerance {
+		regressions = append(regressions, fmt.Sprintf("share of 5xx responses rose from %.1f%% to %.1f%%", was*100, now*100))
+	}
+
+	passedBefore := make(map[string]bool)
+	for _, result := range previous.Expectations {
+		passedBefore[result.Expectation] = result.Passed
+	}
+	for _, result := range current.Expectations {
+		if !result.Passed && passedBefore[result.Expectation] {
+			regressions = append(regressions, fmt.Sprintf("%q passed in the baseline", result.Expectation))
+		}
+	}
+
+	return regressions
+}
+
+func serverErrorRatio(summary LoadSummary) float64 {
+	responses := summary.Requests - summary.Errors
+	if responses == 0 {
+		return 0
+	}
+
+	serverErrors := 0
+	for status, count := range summary.StatusCounts {
+		if status >= 500 {
+			serverErrors += count
+		}
+	}
+	return float64(serverErrors) / float64(responses)
+}
+
+// SaveStressReport writes the report to dir as both id.json and id.html, then
+// deletes the oldest reports beyond keep, 0 keeps them all.
+func SaveStressReport(dir string, report *StressReport, keep int) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, report.Id+".json"), data, 0o644); err != nil {
+		return err
+	}
+
+	file, err := os.Create(filepath.Join(dir, report.Id+".html"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := stressReportTemplate.Execute(file, report); err != nil {
+		return err
+	}
+
+	if keep > 0 {
+		return pruneStressReports(dir, keep)
+	}
+	return nil
+}
+
+// pruneStressReports deletes both files of every report but the keep most
+// recently written ones.
+func pruneStressReports(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	type savedReport struct {
+		id      string
+		modTime time.Time
+	}
+	reports := []savedReport{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() || !stressFileName.MatchString(id) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		reports = append(reports, savedReport{id, info.ModTime()})
+	}
+	if len(reports) <= keep {
+		return nil
+	}
+
+	slices.SortFunc(reports, func(a, b savedReport) int {
+		return b.modTime.Compare(a.modTime)
+	})
+	for _, report := range reports[keep:] {
+		for _, ext := range []string{".json", ".html"} {
+			if err := os.Remove(filepath.Join(dir, report.id+ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LoadStressReport reads a report saved by SaveStressReport, e.g. to use it as a baseline.
+func LoadStressReport(dir, id string) (*StressReport, error) {
+	if !stressFileName.MatchString(id) {
+		return nil, errors.New("Report ids may only contain letters, digits, '-' and '_'.")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Report %q does not exist.", id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var report StressReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("Report %q is not valid JSON: %v", id, err)
+	}
+	return &report, nil
+}
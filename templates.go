@@ -0,0 +1,124 @@
+package main
+
+import (
+	"html/template"
+	"time"
+)
+
+type PasswordPromptPage struct {
+	ShortCode    string
+	ErrorMessage string
+}
+
+var passwordPromptTemplate = template.Must(template.New("password-prompt").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Protected link</title>
+<style>
+body { font-family: system-ui, sans-serif; display: flex; justify-content: center; align-items: center; min-height: 100vh; margin: 0; background: #f4f4f5; }
+form { background: #fff; padding: 2rem; border-radius: 0.5rem; box-shadow: 0 1px 3px rgba(0, 0, 0, 0.1); width: 20rem; }
+h1 { font-size: 1.25rem; margin-top: 0; }
+input, button { width: 100%; box-sizing: border-box; padding: 0.5rem; margin-top: 0.75rem; font-size: 1rem; }
+.error { color: #dc2626; }
+</style>
+</head>
+<body>
+<form method="POST" action="/{{.ShortCode}}">
+<h1>This link is password protected</h1>
+{{if .ErrorMessage}}<p class="error">{{.ErrorMessage}}</p>{{end}}
+<input type="password" name="password" placeholder="Password" autocomplete="current-password" required autofocus>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+type LinkPreviewPage struct {
+	ShortUrl          string
+	ShortCode         string
+	Destination       string // empty for protected links
+	DestinationHost   string
+	PasswordProtected bool
+	RedirectStatus    int
+	RedirectType      string
+	CreatedAt         time.Time
+	ExpiresAt         time.Time
+}
+
+var linkPreviewTemplate = template.Must(template.New("link-preview").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Link preview</title>
+<style>
+body { font-family: system-ui, sans-serif; display: flex; justify-content: center; align-items: center; min-height: 100vh; margin: 0; background: #f4f4f5; }
+main { background: #fff; padding: 2rem; border-radius: 0.5rem; box-shadow: 0 1px 3px rgba(0, 0, 0, 0.1); width: 32rem; max-width: 90vw; }
+h1 { font-size: 1.25rem; margin-top: 0; }
+dt { font-weight: 600; margin-top: 0.75rem; }
+dd { margin: 0.25rem 0 0; word-break: break-all; }
+a.button { display: inline-block; margin-top: 1.5rem; padding: 0.5rem 1rem; background: #18181b; color: #fff; border-radius: 0.375rem; text-decoration: none; }
+</style>
+</head>
+<body>
+<main>
+<h1>Where does {{.ShortUrl}} go?</h1>
+<dl>
+{{if .PasswordProtected}}<dt>Destination</dt><dd>Hidden, this link is password protected</dd>
+{{else}}<dt>Destination</dt><dd>{{.Destination}}</dd>
+<dt>Domain</dt><dd>{{.DestinationHost}}</dd>
+{{end}}<dt>Redirect</dt><dd>{{.RedirectStatus}} {{.RedirectType}}</dd>
+<dt>Created</dt><dd>{{.CreatedAt.UTC.Format "Jan 2, 2006 15:04 MST"}}</dd>
+<dt>Expires</dt><dd>{{.ExpiresAt.UTC.Format "Jan 2, 2006 15:04 MST"}}</dd>
+</dl>
+{{if .PasswordProtected}}<a class="button" href="/{{.ShortCode}}">Unlock link</a>
+{{else}}<a class="button" href="{{.Destination}}" rel="noopener noreferrer">Continue to {{.DestinationHost}}</a>
+{{end}}</main>
+</body>
+</html>
+`))
+
+var stressReportTemplate = template.Must(template.New("stress-report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Stress test report {{.Id}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2rem auto; max-width: 60rem; padding: 0 1rem; background: #f4f4f5; color: #18181b; }
+section { background: #fff; padding: 1rem 1.5rem; border-radius: 0.5rem; box-shadow: 0 1px 3px rgba(0, 0, 0, 0.1); margin-top: 1rem; }
+h1 { font-size: 1.5rem; }
+h2 { font-size: 1.125rem; }
+table { border-collapse: collapse; width: 100%; font-size: 0.875rem; }
+td, th { text-align: left; padding: 0.25rem 0.5rem; border-bottom: 1px solid #e4e4e7; }
+.pass { color: #16a34a; }
+.fail { color: #dc2626; }
+</style>
+</head>
+<body>
+<h1>{{.Suite}}: <span class="{{if .Passed}}pass">passed{{else}}fail">failed{{end}}</span></h1>
+<p>Run {{.Id}}, started {{.StartedAt.UTC.Format "Jan 2, 2006 15:04:05 MST"}}, finished {{.FinishedAt.UTC.Format "15:04:05 MST"}}.
+{{if .Baseline}}Compared with {{.Baseline}}: {{.Regressions}} regression(s).{{end}}</p>
+{{range .Steps}}<section>
+<h2><span class="{{if .Passed}}pass">&#10003;{{else}}fail">&#10007;{{end}}</span> {{.Name}}</h2>
+<p>{{.Scenario.Method}} {{.Scenario.Path}}, {{.Scenario.Concurrency}} workers: {{.Summary.Requests}} requests in {{.Summary.DurationMs}}ms ({{printf "%.0f" .Summary.RequestsPerSec}} req/s), {{.Summary.Errors}} errors</p>
+<table>
+<tr><th>Status</th><th>Responses</th></tr>
+{{range $status, $count := .Summary.StatusCounts}}<tr><td>{{$status}}</td><td>{{$count}}</td></tr>
+{{end}}</table>
+<p>Latency p50 {{.Summary.Latency.P50Ms}}ms, p90 {{.Summary.Latency.P90Ms}}ms, p99 {{.Summary.Latency.P99Ms}}ms, max {{.Summary.Latency.MaxMs}}ms</p>
+{{if .Expectations}}<table>
+<tr><th>Expectation</th><th>Actual</th><th>Result</th></tr>
+{{range .Expectations}}<tr><td>{{.Expectation}}</td><td>{{.Actual}}</td><td class="{{if .Passed}}pass">pass{{else}}fail">fail{{end}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Regressions}}<p class="fail">Regressions:</p>
+<ul>{{range .Regressions}}<li>{{.}}</li>{{end}}</ul>{{end}}
+</section>
+{{end}}</body>
+</html>
+`))
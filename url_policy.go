@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type UrlRejectionReason string
+
+const (
+	ReasonUrlTooLong          UrlRejectionReason = "url_too_long"
+	ReasonInvalidUrl          UrlRejectionReason = "invalid_url"
+	ReasonInvalidScheme       UrlRejectionReason = "invalid_scheme"
+	ReasonEmbeddedCredentials UrlRejectionReason = "embedded_credentials"
+	ReasonSelfReferential     UrlRejectionReason = "self_referential"
+	ReasonBlockedDomain       UrlRejectionReason = "blocked_domain"
+	ReasonPrivateHost         UrlRejectionReason = "private_host"
+)
+
+// UrlRejection explains why a destination url was refused.
+type UrlRejection struct {
+	ErrorMessage string             `json:"errorMessage"`
+	Reason       UrlRejectionReason `json:"reason"`
+}
+
+const (
+	hostResolveTimeout = 2 * time.Second
+	// hostResolveConcurrency bounds the lookups of a batch running at once.
+	hostResolveConcurrency = 8
+)
+
+type UrlPolicy struct {
+	selfHost          string
+	blockedDomains    map[string]struct{}
+	blockedSuffixes   []string // "*.example.com" is stored as ".example.com", it also blocks "example.com"
+	allowPrivateHosts bool
+	resolveHosts      bool
+}
+
+// NewUrlPolicy builds the destination checks applied on top of ValidateUrl.
+// Blocklist entries match a host exactly, or the domain and any of its
+// subdomains when written as "*.example.com".
+func NewUrlPolicy(baseUrl string, blocklist []string, allowPrivateHosts, resolveHosts bool) (*UrlPolicy, error) {
+	base, err := url.Parse(baseUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base url %q: %w", baseUrl, err)
+	}
+
+	policy := &UrlPolicy{
+		selfHost:          strings.TrimPrefix(canonicalHost(base.Hostname()), "www."),
+		blockedDomains:    make(map[string]struct{}),
+		allowPrivateHosts: allowPrivateHosts,
+		resolveHosts:      resolveHosts,
+	}
+
+	for _, entry := range blocklist {
+		entry = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(entry)), ".")
+		if entry == "" {
+			continue
+		}
+
+		if suffix, ok := strings.CutPrefix(entry, "*."); ok {
+			if suffix == "" || strings.ContainsAny(suffix, "*/:") {
+				return nil, fmt.Errorf("invalid blocklist entry %q", entry)
+			}
+			policy.blockedSuffixes = append(policy.blockedSuffixes, "."+suffix)
+			continue
+		}
+
+		if strings.ContainsAny(entry, "*/:") {
+			return nil, fmt.Errorf("invalid blocklist entry %q, wildcards are only allowed as a leading \"*.\"", entry)
+		}
+		policy.blockedDomains[entry] = struct{}{}
+	}
+
+	return policy, nil
+}
+
+// Check returns nil when u may be shortened. Hosts found in resolved are not
+// looked up again, see ResolveHosts.
+func (p *UrlPolicy) Check(u *url.URL, resolved HostResolutions) *UrlRejection {
+	if u.User != nil {
+		return &UrlRejection{"Urls with embedded credentials are not allowed", ReasonEmbeddedCredentials}
+	}
+
+	host := canonicalHost(u.Hostname())
+
+	if p.selfHost != "" && strings.TrimPrefix(host, "www.") == p.selfHost {
+		return &UrlRejection{"Links to this shortener are not allowed", ReasonSelfReferential}
+	}
+
+	if p.isBlocked(host) {
+		return &UrlRejection{"Links to this domain are not allowed", ReasonBlockedDomain}
+	}
+
+	if !p.allowPrivateHosts && p.isPrivateHost(host, resolved) {
+		return &UrlRejection{"Links to private or local network addresses are not allowed", ReasonPrivateHost}
+	}
+
+	return nil
+}
+
+func (p *UrlPolicy) isBlocked(host string) bool {
+	if _, ok := p.blockedDomains[host]; ok {
+		return true
+	}
+	for _, suffix := range p.blockedSuffixes {
+		if strings.HasSuffix(host, suffix) || host == suffix[1:] {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *UrlPolicy) isPrivateHost(host string, resolved HostResolutions) bool {
+	if private, ok := literalHostIsPrivate(host); ok {
+		return private
+	}
+
+	if p.resolveHosts {
+		if private, ok := resolved[host]; ok {
+			return private
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), hostResolveTimeout)
+		defer cancel()
+		return resolvesToPrivateIP(ctx, host)
+	}
+
+	return false
+}
+
+// literalHostIsPrivate answers for hosts that need no lookup, reporting false
+// when host is a name that has to be resolved.
+func literalHostIsPrivate(host string) (private bool, ok bool) {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true, true
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return isPrivateIP(ip), true
+	}
+
+	// browsers accept forms like 2130706433 or 0x7f.1 for 127.0.0.1
+	if ip, ok := numericHostIP(host); ok {
+		return isPrivateIP(ip), true
+	}
+	return false, false
+}
+
+// resolvesToPrivateIP lets unresolvable hosts through, they can't reach
+// anything private either.
+func resolvesToPrivateIP(ctx context.Context, host string) bool {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err == nil {
+		for _, addr := range addrs {
+			if isPrivateIP(addr.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HostResolutions records whether hostnames resolve to a private address.
+type HostResolutions map[string]bool
+
+// ResolveHosts looks up the distinct hostnames of rawUrls up front, at most
+// hostResolveConcurrency at a time and all within hostResolveTimeout, so a
+// batch doesn't wait on one lookup per item. It returns nil when hosts are
+// not resolved.
+func (p *UrlPolicy) ResolveHosts(ctx context.Context, rawUrls []string) HostResolutions {
+	if !p.resolveHosts || p.allowPrivateHosts {
+		return nil
+	}
+
+	var hosts []string
+	seen := make(map[string]struct{})
+	for _, raw := range rawUrls {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		host := canonicalHost(u.Hostname())
+		if _, ok := literalHostIsPrivate(host); ok {
+			continue
+		}
+		if _, ok := seen[host]; !ok {
+			seen[host] = struct{}{}
+			hosts = append(hosts, host)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hostResolveTimeout)
+	defer cancel()
+
+	private := make([]bool, len(hosts))
+	slots := make(chan struct{}, hostResolveConcurrency)
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			private[i] = resolvesToPrivateIP(ctx, host)
+			<-slots
+		}()
+	}
+	wg.Wait()
+
+	resolved := make(HostResolutions, len(hosts))
+	for i, host := range hosts {
+		resolved[host] = private[i]
+	}
+	return resolved
+}
+
+// reservedPrefixes are the ranges not covered by the net.IP checks that still
+// don't lead anywhere public: "this network" and carrier-grade NAT.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// numericHostIP parses the inet_aton style hosts (decimal, octal or hex parts,
+// one to four of them) that net.ParseIP rejects.
+func numericHostIP(host string) (net.IP, bool) {
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return nil, false
+	}
+
+	values := make([]uint64, len(parts))
+	for i, part := range parts {
+		value, err := strconv.ParseUint(part, 0, 32)
+		if err != nil {
+			return nil, false
+		}
+		values[i] = value
+	}
+
+	// every part but the last is a single byte, the last fills the remaining bytes
+	var addr uint64
+	for i, value := range values[:len(values)-1] {
+		if value > 0xff {
+			return nil, false
+		}
+		addr |= value << (8 * (3 - i))
+	}
+	last := values[len(values)-1]
+	if last >= 1<<(8*(5-len(values))) {
+		return nil, false
+	}
+	addr |= last
+
+	return net.IPv4(byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr)), true
+}
+
+func canonicalHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
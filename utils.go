@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -19,17 +21,16 @@ import (
 
 //---------------Middleware utils ----------------
 
-func SetupCors(mux *http.ServeMux, cfg *Config) http.Handler {
-	fmt.Println(cfg.CorsAllowedOrigins)
+func SetupCors(handler http.Handler, cfg *Config) http.Handler {
 	c := cors.New(cors.Options{
 		AllowedOrigins:   cfg.CorsAllowedOrigins,
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "OPTIONS"},
 		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-API-Key"},
 		AllowCredentials: true,
 		Debug:            false,
 	})
 
-	return c.Handler(mux)
+	return c.Handler(handler)
 }
 
 func ComposeMiddlewares(r ...Middleware) Middleware {
@@ -78,25 +79,91 @@ func (fsys FileHidingFileSystem) Open(name string) (http.File, error) {
 	return FileHidingFile{file}, nil
 }
 
-func ValidateUrl(s string, cfg *Config) (string, bool) {
+func ValidateUrl(s string, cfg *Config) (*UrlRejection, bool) {
+	return ValidateResolvedUrl(s, cfg, nil)
+}
+
+// ValidateResolvedUrl is ValidateUrl reusing the host lookups of a batch.
+func ValidateResolvedUrl(s string, cfg *Config, resolved HostResolutions) (*UrlRejection, bool) {
 	if len(s) > cfg.MaxUrlLength {
-		return fmt.Sprintf("Provided url exceeds max-length of %d", cfg.MaxUrlLength), false
+		return &UrlRejection{fmt.Sprintf("Provided url exceeds max-length of %d", cfg.MaxUrlLength), ReasonUrlTooLong}, false
 	}
 
 	u, err := url.Parse(s)
 
 	if err != nil || u.Host == "" {
-		return "Invalid url provided", false
+		return &UrlRejection{"Invalid url provided", ReasonInvalidUrl}, false
 	}
 
 	if u.Scheme != "http" && u.Scheme != "https" {
-		return "Invalid protocol provided. Only http:// or https:// allowed", false
+		return &UrlRejection{"Invalid protocol provided. Only http:// or https:// allowed", ReasonInvalidScheme}, false
+	}
+
+	if rejection := cfg.urlPolicy.Check(u, resolved); rejection != nil {
+		return rejection, false
+	}
+
+	return nil, true
+}
+
+const minAliasLength = 3
+
+func isAliasChar(c rune) bool {
+	return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || c == '-' || c == '_'
+}
+
+func ValidateAlias(alias string, cfg *Config) (string, bool) {
+	if len(alias) < minAliasLength || len(alias) > cfg.MaxAliasLength {
+		return fmt.Sprintf("Alias must be between %d and %d characters long", minAliasLength, cfg.MaxAliasLength), false
+	}
+
+	for _, c := range alias {
+		if !isAliasChar(c) {
+			return "Alias may only contain letters, digits, '-' and '_'", false
+		}
 	}
 
 	return "", true
 }
 
-func EnableGracefulShutdown(logger *slog.Logger, done chan struct{}, server *http.Server) {
+// NormalizeUrl returns a canonical form of s used to compare destinations:
+// scheme and host are lowercased, default ports and fragments are dropped,
+// an empty path becomes "/" and query parameters are sorted.
+func NormalizeUrl(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		// bare IPv6 literal
+		host = "[" + host + "]"
+	}
+	u.Host = host
+
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+	if u.RawQuery != "" {
+		u.RawQuery = u.Query().Encode()
+	}
+
+	return u.String()
+}
+
+// EnableGracefulShutdown shuts server down on SIGINT or SIGTERM, then runs
+// onShutdown (if any) before closing done.
+func EnableGracefulShutdown(logger *slog.Logger, done chan struct{}, server *http.Server, onShutdown func()) {
 
 	// enable Graceful Exit
 	go func() {
@@ -110,6 +177,9 @@ func EnableGracefulShutdown(logger *slog.Logger, done chan struct{}, server *htt
 		if err := server.Shutdown(ctx); err != nil {
 			logger.Error("HTTP server Shutdown failed", "error", err)
 		}
+		if onShutdown != nil {
+			onShutdown()
+		}
 		close(done)
 	}()
 
@@ -120,14 +190,14 @@ func StartTestServer(app *App) (*http.Server, *App, error) {
 	testServer := &http.Server{Addr: app.cfg.TestServerAddr}
 
 	//create global limiter & middleware
-	rateLimitGlobally, globalRateLimiter, err := MakeGlobalRateLimitMiddleware(app.logger, InMemory, app.cfg.GlobalLimiterCount, app.cfg.GlobalLimiterCap, app.cfg.GlobalLimiterRate)
+	rateLimitGlobally, globalRateLimiter, err := MakeGlobalRateLimitMiddleware(app.logger, nil, app.cfg.StorageType, app.cfg.GlobalLimiterCount, app.cfg.GlobalLimiterCap, app.cfg.GlobalLimiterRate, app.cfg.GlobalLimiterShadow)
 
 	if err != nil {
 		return nil, nil, errors.New("Failed to create global rate limiter for stress test.")
 	}
 
 	//create per client limiter & middleware
-	rateLimitPerClient, perClientRateLimiter, err := MakePerClientRateLimitMiddleware(app.logger, InMemory, app.cfg.PerClientLimiterCap, app.cfg.PerClientLimiterLimit, app.cfg.PerClientLimiterWindow, app.cfg.PerClientLimiterClientTtl)
+	rateLimitPerClient, perClientRateLimiter, err := MakePerClientRateLimitMiddleware(app.logger, nil, app.cfg.StorageType, app.cfg.PerClientLimiterCap, app.cfg.PerClientLimiterLimit, app.cfg.PerClientLimiterWindow, app.cfg.PerClientLimiterClientTtl, app.cfg.ClientMask, app.cfg.PerClientLimiterShadow)
 	if err != nil {
 		globalRateLimiter.Offline()
 		return nil, nil, errors.New("Failed to create per client rate limiter for stress test.")
@@ -137,20 +207,31 @@ func StartTestServer(app *App) (*http.Server, *App, error) {
 	withMiddlewares := ComposeMiddlewares(rateLimitGlobally, rateLimitPerClient)
 
 	//url shortener struct
-	shortener, err := NewUrlShortener(InMemory, app.cfg.ShortenerCap, app.cfg.ShortenerTTL, app.cfg.ShortCodeLength)
+	shortener, err := NewUrlShortener(app.cfg.StorageType, app.cfg.ShortenerCap, app.cfg.ShortenerTTL, app.cfg.ShortCodeLength, app.cfg.ShortenerDedupe, app.cfg.ShortenerEviction)
 	if err != nil {
 		globalRateLimiter.Offline()
 		perClientRateLimiter.Offline()
 		return nil, nil, errors.New("Failed to create shortener instance for stress test.")
 	}
 
-	testApp := &App{app.cfg, app.logger, "Not Found", shortener, globalRateLimiter, perClientRateLimiter}
+	passwordAttemptLimiter, err := newPerClientRateLimiter(InMemory, app.cfg.ShortenerCap, app.cfg.PasswordAttemptLimit, app.cfg.PasswordAttemptWindow, app.cfg.PasswordAttemptWindow)
+	if err != nil {
+		globalRateLimiter.Offline()
+		perClientRateLimiter.Offline()
+		shortener.Offline()
+		return nil, nil, errors.New("Failed to create password attempt limiter for stress test.")
+	}
+
+	testApp := &App{app.cfg, app.logger, "Not Found", shortener, globalRateLimiter, perClientRateLimiter, nil, passwordAttemptLimiter, nil, nil, nil, nil, nil}
 
 	//Route handlers
 	mux := http.NewServeMux()
 	mux.Handle("/", rateLimitGlobally(MakeIndexHandler()))
 	mux.Handle("GET /{shortUrl}", rateLimitGlobally(http.HandlerFunc(testApp.RetrieveUrl)))
+	mux.Handle("POST /{shortUrl}", rateLimitGlobally(http.HandlerFunc(testApp.UnlockUrl)))
+	mux.Handle("GET /api/qr/{shortUrl}", rateLimitGlobally(http.HandlerFunc(testApp.QRCode)))
 	mux.Handle("POST /api/shorten", withMiddlewares(http.HandlerFunc(testApp.ShortenUrl)))
+	mux.Handle("POST /api/shorten/batch", rateLimitGlobally(http.HandlerFunc(testApp.ShortenBatch)))
 
 	//No metrics Streaming for stress test server
 	// mux.Handle("GET /api/metrics/stream", rateLimitGlobally(http.HandlerFunc(app.StreamMetrics)))
@@ -161,17 +242,17 @@ func StartTestServer(app *App) (*http.Server, *App, error) {
 
 }
 
-func MakeStressTestRouteMiddlewares(logger *slog.Logger) (Middleware, func(), error) {
+func MakeStressTestRouteMiddlewares(logger *slog.Logger, mask ClientMask) (Middleware, func(), error) {
 	cfg := LoadStressTestRouteMiddlewareConfig()
 
 	//create global limiter & middleware
-	rateLimitGlobally, globalRateLimiter, err := MakeGlobalRateLimitMiddleware(logger, InMemory, cfg.GlobalLimiterCount, cfg.GlobalLimiterCap, cfg.GlobalLimiterRate)
+	rateLimitGlobally, globalRateLimiter, err := MakeGlobalRateLimitMiddleware(logger, nil, InMemory, cfg.GlobalLimiterCount, cfg.GlobalLimiterCap, cfg.GlobalLimiterRate, false)
 	if err != nil {
 		return nil, nil, errors.New("Failed to create global rate limiter for stress test route.")
 	}
 
 	//create per client limiter & middleware
-	rateLimitPerClient, perClientRateLimiter, err := MakePerClientRateLimitMiddleware(logger, InMemory, cfg.PerClientLimiterCap, cfg.PerClientLimiterLimit, cfg.PerClientLimiterWindow, cfg.PerClientLimiterClientTtl)
+	rateLimitPerClient, perClientRateLimiter, err := MakePerClientRateLimitMiddleware(logger, nil, InMemory, cfg.PerClientLimiterCap, cfg.PerClientLimiterLimit, cfg.PerClientLimiterWindow, cfg.PerClientLimiterClientTtl, mask, false)
 	if err != nil {
 		globalRateLimiter.Offline()
 		return nil, nil, errors.New("Failed to create per client rate limiter for stress test route.")
@@ -185,9 +266,24 @@ func MakeStressTestRouteMiddlewares(logger *slog.Logger) (Middleware, func(), er
 }
 
 func SendSSEErrorEvent(w http.ResponseWriter, message string, f http.Flusher) {
-	fmt.Fprintf(w, "event: error\ndata: {\"errorMessage\": \"%s\"}\n\n", message)
+	data, _ := json.Marshal(&ErrorResponse{message})
+	fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+
+	f.Flush()
+}
+
+// SendSSEJSONEvent writes v as the data of a named event.
+func SendSSEJSONEvent(w http.ResponseWriter, event string, v any, f http.Flusher) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
 
 	f.Flush()
+	return nil
 }
 
 func Load404Page() (string, error) {